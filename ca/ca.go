@@ -0,0 +1,303 @@
+// Package ca generates, loads and exports the certificate authorities used by
+// goproxy to sign the certificates of MITM'd hosts, as a replacement for the
+// built-in goproxy.GoproxyCa.
+//
+//	authority, err := ca.Generate(ca.Config{Subject: pkix.Name{CommonName: "My proxy CA"}})
+//	...
+//	err = authority.WriteFiles("ca.pem", "ca.key.pem")
+//	...
+//	mitm := &goproxy.ConnectAction{
+//		Action:    goproxy.ConnectMitm,
+//		TLSConfig: goproxy.TLSConfigFromCA(authority.TLSCertificate()),
+//	}
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// KeyType is the algorithm of the key of a CA. The certificates it signs get
+// a key of the same algorithm.
+type KeyType int
+
+const (
+	// ECDSA generates P-256 keys.
+	ECDSA KeyType = iota
+	// RSA generates keys of Config.RSABits bits.
+	RSA
+	// Ed25519 generates Ed25519 keys, that most browsers don't support.
+	Ed25519
+)
+
+const (
+	// DefaultValidity is the validity of the generated CAs, 20 years like
+	// the ones of certs/openssl-gen.sh.
+	DefaultValidity = 20 * 365 * 24 * time.Hour
+	// DefaultRSABits is the size of the generated RSA keys.
+	DefaultRSABits = 2048
+)
+
+// Config describes a CA to generate. The zero value generates a CA with an
+// ECDSA key, valid for DefaultValidity.
+type Config struct {
+	KeyType KeyType
+	// RSABits is the size of RSA keys, DefaultRSABits when zero
+	RSABits int
+	// Subject of the CA certificate, "GoProxy MITM CA" when empty
+	Subject pkix.Name
+	// NotBefore is the start of the validity, an hour ago when zero, to
+	// tolerate the clock skew of the clients
+	NotBefore time.Time
+	// Validity is the duration of the validity, DefaultValidity when zero
+	Validity time.Duration
+
+	// Name constraints, limiting the hosts the CA can sign certificates for.
+	// Clients reject the certificates of other hosts, even though they trust
+	// the CA.
+	PermittedDNSDomains []string
+	ExcludedDNSDomains  []string
+	PermittedIPRanges   []*net.IPNet
+	ExcludedIPRanges    []*net.IPNet
+}
+
+// CA is a certificate authority, able to sign the certificates of MITM'd
+// hosts.
+type CA struct {
+	// Certificate signing the certificates of the hosts
+	Certificate *x509.Certificate
+	// PrivateKey of Certificate
+	PrivateKey crypto.Signer
+	// Chain holds Certificate, followed by the certificates of its issuers up
+	// to the root CA, the one clients need to trust
+	Chain []*x509.Certificate
+}
+
+func generateKey(cfg *Config) (crypto.Signer, error) {
+	switch cfg.KeyType {
+	case ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case RSA:
+		bits := cfg.RSABits
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %d", cfg.KeyType)
+	}
+}
+
+func (cfg *Config) template() (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	subject := cfg.Subject
+	if subject.CommonName == "" && len(subject.Organization) == 0 {
+		subject = pkix.Name{CommonName: "GoProxy MITM CA", Organization: []string{"GoProxy"}}
+	}
+	notBefore := cfg.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now().Add(-time.Hour)
+	}
+	validity := cfg.Validity
+	if validity == 0 {
+		validity = DefaultValidity
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+
+		PermittedDNSDomainsCritical: len(cfg.PermittedDNSDomains) > 0 || len(cfg.PermittedIPRanges) > 0,
+		PermittedDNSDomains:         cfg.PermittedDNSDomains,
+		ExcludedDNSDomains:          cfg.ExcludedDNSDomains,
+		PermittedIPRanges:           cfg.PermittedIPRanges,
+		ExcludedIPRanges:            cfg.ExcludedIPRanges,
+	}, nil
+}
+
+// Generate creates a self-signed root CA.
+func Generate(cfg Config) (*CA, error) {
+	template, err := cfg.template()
+	if err != nil {
+		return nil, err
+	}
+	key, err := generateKey(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return create(template, template, key.Public(), key, key, nil)
+}
+
+// NewIntermediate creates an intermediate CA signed by ca. Intermediate CAs
+// can only sign the certificates of hosts, and their validity is clamped to
+// the one of ca.
+func (ca *CA) NewIntermediate(cfg Config) (*CA, error) {
+	template, err := cfg.template()
+	if err != nil {
+		return nil, err
+	}
+	template.MaxPathLenZero = true
+	if template.NotBefore.Before(ca.Certificate.NotBefore) {
+		template.NotBefore = ca.Certificate.NotBefore
+	}
+	if template.NotAfter.After(ca.Certificate.NotAfter) {
+		template.NotAfter = ca.Certificate.NotAfter
+	}
+	key, err := generateKey(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return create(template, ca.Certificate, key.Public(), ca.PrivateKey, key, ca.Chain)
+}
+
+func create(
+	template, parent *x509.Certificate,
+	pub crypto.PublicKey,
+	signer crypto.Signer,
+	key crypto.Signer,
+	chain []*x509.Certificate,
+) (*CA, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{
+		Certificate: cert,
+		PrivateKey:  key,
+		Chain:       append([]*x509.Certificate{cert}, chain...),
+	}, nil
+}
+
+// Load parses a CA from the PEM encoding of its certificate chain, starting
+// with the certificate signing the certificates of the hosts, and of its
+// private key, in PKCS #1, SEC 1 or PKCS #8 form.
+func Load(certPEM, keyPEM []byte) (*CA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CA{}
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		ca.Chain = append(ca.Chain, cert)
+	}
+	ca.Certificate = ca.Chain[0]
+	if !ca.Certificate.IsCA {
+		return nil, errors.New("the certificate is not a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", pair.PrivateKey)
+	}
+	ca.PrivateKey = key
+	return ca, nil
+}
+
+// LoadFiles parses a CA from the PEM files at certFile and keyFile, see Load.
+func LoadFiles(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return Load(certPEM, keyPEM)
+}
+
+// CertificatePEM returns the PEM encoding of the certificate chain.
+func (ca *CA) CertificatePEM() []byte {
+	var buf bytes.Buffer
+	for _, cert := range ca.Chain {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// KeyPEM returns the PEM encoding of the private key, in PKCS #8 form.
+func (ca *CA) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// WriteFiles writes the PEM encoding of the certificate chain to certFile,
+// and of the private key to keyFile, that only the user can read.
+func (ca *CA) WriteFiles(certFile, keyFile string) error {
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, ca.CertificatePEM(), 0o644)
+}
+
+// Root returns the certificate of the root CA, that clients need to trust.
+func (ca *CA) Root() *x509.Certificate {
+	return ca.Chain[len(ca.Chain)-1]
+}
+
+// RootDER returns the DER encoding of the certificate of the root CA, the
+// ".cer" or ".crt" files that clients import in their trust stores.
+func (ca *CA) RootDER() []byte {
+	return ca.Root().Raw
+}
+
+// Fingerprint returns the hexadecimal SHA-256 fingerprint of the certificate.
+func (ca *CA) Fingerprint() string {
+	sum := sha256.Sum256(ca.Certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// TLSCertificate returns the CA as a tls.Certificate, to be passed to
+// goproxy.TLSConfigFromCA. The certificates of the hosts are sent along with
+// the chain of the CA.
+func (ca *CA) TLSCertificate() *tls.Certificate {
+	cert := &tls.Certificate{
+		PrivateKey: ca.PrivateKey,
+		Leaf:       ca.Certificate,
+	}
+	for _, c := range ca.Chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
@@ -0,0 +1,208 @@
+package ca_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ca"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signHost returns the certificate that goproxy generates for host with
+// authority.
+func signHost(t *testing.T, authority *ca.CA, host string) *x509.Certificate {
+	t.Helper()
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	config, err := goproxy.TLSConfigFromCA(authority.TLSCertificate())(host+":443", ctx)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	return leaf
+}
+
+func verify(authority *ca.CA, leaf *x509.Certificate, host string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Root())
+	intermediates := x509.NewCertPool()
+	for _, cert := range authority.Chain {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+func TestGenerate(t *testing.T) {
+	for name, keyType := range map[string]ca.KeyType{"ECDSA": ca.ECDSA, "RSA": ca.RSA, "Ed25519": ca.Ed25519} {
+		t.Run(name, func(t *testing.T) {
+			authority, err := ca.Generate(ca.Config{KeyType: keyType, Validity: 24 * time.Hour})
+			require.NoError(t, err)
+			assert.True(t, authority.Certificate.IsCA)
+			assert.Equal(t, "GoProxy MITM CA", authority.Certificate.Subject.CommonName)
+			assert.Equal(t, 24*time.Hour, authority.Certificate.NotAfter.Sub(authority.Certificate.NotBefore))
+			assert.Same(t, authority.Certificate, authority.Root())
+			require.NoError(t, authority.Certificate.CheckSignatureFrom(authority.Certificate))
+
+			assert.NoError(t, verify(authority, signHost(t, authority, "example.com"), "example.com"))
+		})
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	authority, err := ca.Generate(ca.Config{
+		Subject:             pkix.Name{CommonName: "constrained"},
+		PermittedDNSDomains: []string{"example.com"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "constrained", authority.Certificate.Subject.CommonName)
+	assert.NoError(t, verify(authority, signHost(t, authority, "www.example.com"), "www.example.com"))
+	assert.Error(t, verify(authority, signHost(t, authority, "example.org"), "example.org"))
+}
+
+func TestIntermediate(t *testing.T) {
+	root, err := ca.Generate(ca.Config{Validity: 48 * time.Hour})
+	require.NoError(t, err)
+	intermediate, err := root.NewIntermediate(ca.Config{Subject: pkix.Name{CommonName: "intermediate"}})
+	require.NoError(t, err)
+	require.Len(t, intermediate.Chain, 2)
+	assert.Same(t, root.Certificate, intermediate.Root())
+	assert.Equal(t, root.Certificate.NotAfter, intermediate.Certificate.NotAfter)
+	assert.True(t, intermediate.Certificate.MaxPathLenZero)
+
+	leaf := signHost(t, intermediate, "example.com")
+	require.NoError(t, leaf.CheckSignatureFrom(intermediate.Certificate))
+	assert.NoError(t, verify(intermediate, leaf, "example.com"))
+	// The chain of the intermediate CA is sent along with the certificate
+	assert.Len(t, intermediate.TLSCertificate().Certificate, 2)
+}
+
+func TestPEM(t *testing.T) {
+	root, err := ca.Generate(ca.Config{KeyType: ca.RSA})
+	require.NoError(t, err)
+	intermediate, err := root.NewIntermediate(ca.Config{})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key.pem")
+	require.NoError(t, intermediate.WriteFiles(certFile, keyFile))
+	fi, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	loaded, err := ca.LoadFiles(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, intermediate.Fingerprint(), loaded.Fingerprint())
+	require.Len(t, loaded.Chain, 2)
+	assert.Equal(t, root.RootDER(), loaded.RootDER())
+	assert.NoError(t, verify(loaded, signHost(t, loaded, "example.com"), "example.com"))
+
+	// The built-in CA can be loaded too
+	builtin, err := ca.Load(goproxy.CA_CERT, goproxy.CA_KEY)
+	require.NoError(t, err)
+	assert.Equal(t, goproxy.GoproxyCa.Leaf.Raw, builtin.RootDER())
+
+	// Certificates that aren't CAs are rejected
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	config, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)("example.com:443", ctx)
+	require.NoError(t, err)
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: config.Certificates[0].Certificate[0]})
+	keyDER, err := x509.MarshalPKCS8PrivateKey(config.Certificates[0].PrivateKey)
+	require.NoError(t, err)
+	_, err = ca.Load(leafPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	assert.Error(t, err)
+}
+
+func openssl(t *testing.T, stdin []byte, args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	cmd := exec.Command("openssl", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return string(out)
+}
+
+// namesStorage records the names of the certificates fetched from its
+// LRUCertStorage.
+type namesStorage struct {
+	*goproxy.LRUCertStorage
+
+	mtx   sync.Mutex
+	names []string
+}
+
+func (s *namesStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	s.mtx.Lock()
+	s.names = append(s.names, hostname)
+	s.mtx.Unlock()
+	return s.LRUCertStorage.Fetch(hostname, gen)
+}
+
+func TestRotator(t *testing.T) {
+	first, err := ca.Generate(ca.Config{Subject: pkix.Name{CommonName: "first"}})
+	require.NoError(t, err)
+	second, err := ca.Generate(ca.Config{Subject: pkix.Name{CommonName: "second"}})
+	require.NoError(t, err)
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	rotator := ca.NewRotator(first, goproxy.WithCertStorageNamespace("tenant:"))
+	proxy := goproxy.NewProxyHttpServer()
+	storage := &namesStorage{LRUCertStorage: goproxy.NewLRUCertStorage(10)}
+	proxy.CertStore = storage
+	mitm := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: rotator.TLSConfig}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first.Root())
+	roots.AddCert(second.Root())
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		DisableKeepAlives: true,
+	}}
+	issuer := func() string {
+		t.Helper()
+		resp, err := client.Get(backend.URL)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Issuer.CommonName
+	}
+
+	assert.Equal(t, "first", issuer())
+	assert.Equal(t, "first", issuer())
+	rotator.Rotate(second)
+	assert.Same(t, second, rotator.CA())
+	assert.Equal(t, "second", issuer())
+	assert.Equal(t, 2, storage.Len())
+
+	// The namespace of the caller is kept, followed by the one of the CA
+	require.Len(t, storage.names, 3)
+	assert.True(t, strings.HasPrefix(storage.names[0], "tenant:"+first.Fingerprint()+":"), storage.names[0])
+	assert.True(t, strings.HasPrefix(storage.names[2], "tenant:"+second.Fingerprint()+":"), storage.names[2])
+}
@@ -0,0 +1,450 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // OCSP clients identify the issuer by SHA-1 hashes
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// DefaultRevocationValidity is how long the OCSP responses and the CRLs of
+// a Responder are valid.
+const DefaultRevocationValidity = 24 * time.Hour
+
+const (
+	contentTypeOCSPResponse = "application/ocsp-response"
+	contentTypeCRL          = "application/pkix-crl"
+
+	maxOCSPRequestSize = 64 << 10
+)
+
+// OCSP response statuses, RFC 6960 section 4.2.1
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+)
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+	asn1NULL = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+// OCSP requests and responses, RFC 6960 section 4
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+	Signature  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type tbsRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []singleRequest
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type singleRequest struct {
+	CertID     asn1.RawValue
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type certID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspResponse struct {
+	Status asn1.Enumerated
+	Bytes  responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	Type     asn1.ObjectIdentifier
+	Response []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type responseData struct {
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []singleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type singleResponse struct {
+	CertID     asn1.RawValue
+	Status     asn1.RawValue
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+// Responder answers the OCSP and CRL requests for the certificates signed by
+// a CA, so that clients checking their revocation accept them. The URL of the
+// responder is embedded in the certificates with SignerOptions.
+//
+//	responder, err := ca.NewResponder(authority, "http://revocation.goproxy")
+//	...
+//	tlsConfig := goproxy.TLSConfigFromCA(authority.TLSCertificate(),
+//		goproxy.WithSignerOptions(responder.SignerOptions(goproxy.SignerOptions{})))
+//	proxy.OnRequest().DoFunc(responder.OnRequest)
+//
+// Clients fetching the revocation information through the proxy are answered
+// by OnRequest. Otherwise, the URL must point at a server where the Responder
+// is the handler, like the NonproxyHandler of the proxy.
+//
+// All the certificates are reported as valid, except the revoked ones.
+type Responder struct {
+	// Validity is how long the responses are valid, DefaultRevocationValidity
+	// when zero. Set it before use.
+	Validity time.Duration
+
+	ca        *CA
+	url       *url.URL
+	keyHashes map[string][]byte // by hash algorithm OID
+
+	mtx       sync.Mutex
+	revoked   map[string]x509.RevocationListEntry // by serial number
+	crl       []byte
+	crlNumber int64
+	crlExpiry time.Time
+}
+
+// NewResponder creates a Responder for the certificates signed by ca,
+// reachable at baseURL. OCSP requests are answered at baseURL/ocsp, and the
+// CRL at baseURL/crl.
+func NewResponder(ca *CA, baseURL string) (*Responder, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("invalid responder URL %s, OCSP and CRL URLs must be absolute http URLs", baseURL)
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.Certificate.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	r := &Responder{
+		ca:        ca,
+		url:       u,
+		keyHashes: make(map[string][]byte),
+		revoked:   make(map[string]x509.RevocationListEntry),
+	}
+	for _, oid := range []asn1.ObjectIdentifier{oidSHA1, oidSHA256, oidSHA384, oidSHA512} {
+		h := newHash(oid)
+		h.Write(spki.PublicKey.RightAlign())
+		r.keyHashes[oid.String()] = h.Sum(nil)
+	}
+	return r, nil
+}
+
+func newHash(oid asn1.ObjectIdentifier) hash.Hash {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New() //nolint:gosec // see import
+	case oid.Equal(oidSHA256):
+		return sha256.New()
+	case oid.Equal(oidSHA384):
+		return sha512.New384()
+	case oid.Equal(oidSHA512):
+		return sha512.New()
+	default:
+		return nil
+	}
+}
+
+// OCSPURL returns the URL answering OCSP requests.
+func (r *Responder) OCSPURL() string {
+	return r.url.String() + "/ocsp"
+}
+
+// CRLURL returns the URL of the CRL.
+func (r *Responder) CRLURL() string {
+	return r.url.String() + "/crl"
+}
+
+// SignerOptions returns opts, with the URLs of the responder as OCSP server
+// and CRL distribution point.
+func (r *Responder) SignerOptions(opts goproxy.SignerOptions) goproxy.SignerOptions {
+	opts.OCSPServer = []string{r.OCSPURL()}
+	opts.CRLDistributionPoints = []string{r.CRLURL()}
+	return opts
+}
+
+// Revoke reports the certificate with the given serial number as revoked.
+func (r *Responder) Revoke(serial *big.Int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.revoked[serial.String()]; ok {
+		return
+	}
+	r.revoked[serial.String()] = x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: time.Now().UTC().Truncate(time.Second),
+	}
+	r.crl = nil
+}
+
+func (r *Responder) validity() time.Duration {
+	if r.Validity == 0 {
+		return DefaultRevocationValidity
+	}
+	return r.Validity
+}
+
+// CRL returns the DER encoding of the CRL, which is signed again once half
+// of its validity has passed or when a certificate is revoked.
+func (r *Responder) CRL() ([]byte, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	if r.crl != nil && now.Before(r.crlExpiry) {
+		return r.crl, nil
+	}
+
+	template := &x509.RevocationList{
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(r.validity()),
+	}
+	for _, entry := range r.revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, entry)
+	}
+	r.crlNumber++
+	template.Number = big.NewInt(r.crlNumber)
+	crl, err := x509.CreateRevocationList(rand.Reader, template, r.ca.Certificate, r.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	r.crl, r.crlExpiry = crl, now.Add(r.validity()/2)
+	return crl, nil
+}
+
+// certStatus returns the status of the certificate id in an OCSP response.
+func (r *Responder) certStatus(id *certID) (asn1.RawValue, error) {
+	h := newHash(id.HashAlgorithm.Algorithm)
+	keyHash := r.keyHashes[id.HashAlgorithm.Algorithm.String()]
+	if h == nil || string(id.IssuerKeyHash) != string(keyHash) {
+		// Unknown
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2}, nil
+	}
+	h.Write(r.ca.Certificate.RawSubject)
+	if string(id.IssuerNameHash) != string(h.Sum(nil)) {
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2}, nil
+	}
+
+	r.mtx.Lock()
+	entry, revoked := r.revoked[id.SerialNumber.String()]
+	r.mtx.Unlock()
+	if !revoked {
+		// Good
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}, nil
+	}
+	revocationTime, err := asn1.MarshalWithParams(entry.RevocationTime, "generalized")
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: revocationTime}, nil
+}
+
+// sign returns the signature algorithm and the signature of data.
+func (r *Responder) sign(data []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	digest := sha256.Sum256(data)
+	switch r.ca.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		signature, err := r.ca.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1NULL}, signature, err
+	case *ecdsa.PublicKey:
+		signature, err := r.ca.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, signature, err
+	case ed25519.PublicKey:
+		signature, err := r.ca.PrivateKey.Sign(rand.Reader, data, crypto.Hash(0))
+		return pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, signature, err
+	default:
+		return pkix.AlgorithmIdentifier{}, nil, fmt.Errorf("unsupported key type %T", r.ca.PrivateKey)
+	}
+}
+
+func ocspStatus(status asn1.Enumerated) []byte {
+	der, _ := asn1.Marshal(ocspResponse{Status: status})
+	return der
+}
+
+// OCSP returns the DER encoding of the OCSP response to the DER encoded
+// request. Malformed requests get a response with an error status.
+func (r *Responder) OCSP(request []byte) []byte {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(request, &req); err != nil || len(rest) > 0 || len(req.TBSRequest.RequestList) == 0 {
+		return ocspStatus(ocspMalformedRequest)
+	}
+	response, err := r.ocsp(&req)
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+	return response
+}
+
+func (r *Responder) ocsp(req *ocspRequest) ([]byte, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	keyHash, err := asn1.Marshal(r.keyHashes[oidSHA1.String()])
+	if err != nil {
+		return nil, err
+	}
+	data := responseData{
+		// By key, RFC 6960 section 4.2.1
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  now,
+	}
+	for _, single := range req.TBSRequest.RequestList {
+		var id certID
+		if _, err := asn1.Unmarshal(single.CertID.FullBytes, &id); err != nil {
+			return ocspStatus(ocspMalformedRequest), nil
+		}
+		status, err := r.certStatus(&id)
+		if err != nil {
+			return nil, err
+		}
+		data.Responses = append(data.Responses, singleResponse{
+			CertID:     single.CertID,
+			Status:     status,
+			ThisUpdate: now.Add(-time.Minute),
+			NextUpdate: now.Add(r.validity()),
+		})
+	}
+	// The nonce protects clients from replayed responses
+	for _, ext := range req.TBSRequest.Extensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			data.Extensions = append(data.Extensions, ext)
+		}
+	}
+
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, signature, err := r.sign(tbs)
+	if err != nil {
+		return nil, err
+	}
+	basic, err := asn1.Marshal(basicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: algorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspResponse{
+		Status: ocspSuccessful,
+		Bytes:  responseBytes{Type: oidOCSPBasic, Response: basic},
+	})
+}
+
+// respond answers req, returning the status, the content type and the body
+// of the response.
+func (r *Responder) respond(req *http.Request) (int, string, []byte) {
+	path := strings.TrimPrefix(req.URL.Path, r.url.Path)
+	switch {
+	case path == "/crl" && req.Method == http.MethodGet:
+		crl, err := r.CRL()
+		if err != nil {
+			return http.StatusInternalServerError, goproxy.ContentTypeText, []byte(err.Error())
+		}
+		return http.StatusOK, contentTypeCRL, crl
+
+	case path == "/ocsp" && req.Method == http.MethodPost:
+		request, err := io.ReadAll(io.LimitReader(req.Body, maxOCSPRequestSize))
+		if err != nil {
+			return http.StatusBadRequest, goproxy.ContentTypeText, []byte(err.Error())
+		}
+		return http.StatusOK, contentTypeOCSPResponse, r.OCSP(request)
+
+	case strings.HasPrefix(path, "/ocsp/") && req.Method == http.MethodGet:
+		// RFC 6960 appendix A.1, the request is base64 and URL encoded in
+		// the path, and its slashes may not be escaped
+		encoded := strings.TrimPrefix(req.URL.EscapedPath(), r.url.EscapedPath()+"/ocsp/")
+		unescaped, err := url.PathUnescape(encoded)
+		if err != nil {
+			return http.StatusBadRequest, goproxy.ContentTypeText, []byte(err.Error())
+		}
+		request, err := base64.StdEncoding.DecodeString(unescaped)
+		if err != nil {
+			return http.StatusOK, contentTypeOCSPResponse, ocspStatus(ocspMalformedRequest)
+		}
+		return http.StatusOK, contentTypeOCSPResponse, r.OCSP(request)
+
+	default:
+		return http.StatusNotFound, goproxy.ContentTypeText, []byte("not found")
+	}
+}
+
+// ServeHTTP answers the OCSP and CRL requests sent directly to the responder.
+func (r *Responder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status, contentType, body := r.respond(req)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// hostPort returns the host of u with its port, the default one of the
+// scheme when missing.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// OnRequest answers the OCSP and CRL requests sent through the proxy to the
+// URL of the responder, letting the other requests through.
+func (r *Responder) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.URL.Scheme != "http" || hostPort(req.URL) != hostPort(r.url) ||
+		!strings.HasPrefix(req.URL.Path, r.url.Path+"/") {
+		return req, nil
+	}
+	status, contentType, body := r.respond(req)
+	ctx.Logf("ca: answering revocation request %v %v with status %d", req.Method, req.URL.Path, status)
+	return req, goproxy.NewResponse(req, contentType, status, string(body))
+}
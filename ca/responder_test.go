@@ -0,0 +1,122 @@
+package ca_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ca"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, path string, cert *x509.Certificate) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644))
+}
+
+func TestResponderOCSP(t *testing.T) {
+	authority, err := ca.Generate(ca.Config{Subject: pkix.Name{CommonName: "revocation"}})
+	require.NoError(t, err)
+
+	var responder *ca.Responder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responder.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	responder, err = ca.NewResponder(authority, server.URL+"/revocation")
+	require.NoError(t, err)
+
+	tlsConfig := goproxy.TLSConfigFromCA(authority.TLSCertificate(),
+		goproxy.WithSignerOptions(responder.SignerOptions(goproxy.SignerOptions{})))
+	config, err := tlsConfig("example.com:443", &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{server.URL + "/revocation/ocsp"}, leaf.OCSPServer)
+	assert.Equal(t, []string{server.URL + "/revocation/crl"}, leaf.CRLDistributionPoints)
+
+	dir := t.TempDir()
+	caFile, leafFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "leaf.pem")
+	writePEM(t, caFile, authority.Certificate)
+	writePEM(t, leafFile, leaf)
+	check := func() string {
+		t.Helper()
+		return openssl(t, nil, "ocsp", "-issuer", caFile, "-cert", leafFile, "-CAfile", caFile,
+			"-url", leaf.OCSPServer[0])
+	}
+
+	out := check()
+	assert.Contains(t, out, "Response verify OK")
+	assert.Contains(t, out, leafFile+": good")
+
+	responder.Revoke(leaf.SerialNumber)
+	out = check()
+	assert.Contains(t, out, "Response verify OK")
+	assert.Contains(t, out, leafFile+": revoked")
+
+	// Malformed requests are answered with the malformedRequest status
+	resp, err := http.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader([]byte("bobo")))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, []byte{0x30, 0x03, 0x0a, 0x01, 0x01}, body)
+}
+
+func TestResponderCRL(t *testing.T) {
+	authority, err := ca.Generate(ca.Config{})
+	require.NoError(t, err)
+	responder, err := ca.NewResponder(authority, "http://revocation.goproxy")
+	require.NoError(t, err)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(responder.OnRequest)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTeapot, "not the responder")
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	fetch := func(u string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := client.Get(u)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp, body
+	}
+
+	resp, body := fetch(responder.CRLURL())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/pkix-crl", resp.Header.Get("Content-Type"))
+	crl, err := x509.ParseRevocationList(body)
+	require.NoError(t, err)
+	require.NoError(t, crl.CheckSignatureFrom(authority.Certificate))
+	assert.Empty(t, crl.RevokedCertificateEntries)
+
+	leaf := signHost(t, authority, "example.com")
+	responder.Revoke(leaf.SerialNumber)
+	_, body = fetch(responder.CRLURL())
+	revoked, err := x509.ParseRevocationList(body)
+	require.NoError(t, err)
+	require.Len(t, revoked.RevokedCertificateEntries, 1)
+	assert.Equal(t, leaf.SerialNumber, revoked.RevokedCertificateEntries[0].SerialNumber)
+	assert.Equal(t, 1, revoked.Number.Cmp(crl.Number))
+
+	// Other requests are let through
+	resp, _ = fetch("http://example.com/crl")
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+}
@@ -0,0 +1,74 @@
+package ca
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Rotator signs the certificates of MITM'd hosts with a CA that can be
+// replaced while the proxy is running, for example before the current one
+// expires.
+//
+//	rotator := ca.NewRotator(authority)
+//	mitm := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: rotator.TLSConfig}
+//	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(
+//		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+//			return mitm, host
+//		}))
+//	...
+//	rotator.Rotate(newAuthority)
+//
+// The certificates are stored in the CertStorage of the proxy under the
+// fingerprint of the CA signing them, following the namespace set with
+// goproxy.WithCertStorageNamespace if any, so that the certificates of a
+// previous CA are never served after a rotation. Connections established
+// before a rotation keep their certificate.
+//
+// A rotation doesn't remove the certificates of the previous CA from the
+// storage: an LRUCertStorage only evicts them once it is full. Purge the
+// storage after a rotation to free them right away.
+type Rotator struct {
+	opts []goproxy.TLSConfigOption
+
+	mtx       sync.RWMutex
+	ca        *CA
+	tlsConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
+}
+
+// NewRotator creates a Rotator signing certificates with ca, configured by
+// opts like goproxy.TLSConfigFromCA.
+func NewRotator(ca *CA, opts ...goproxy.TLSConfigOption) *Rotator {
+	r := &Rotator{opts: opts}
+	r.Rotate(ca)
+	return r
+}
+
+// CA returns the CA currently signing the certificates.
+func (r *Rotator) CA() *CA {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.ca
+}
+
+// Rotate makes ca sign the certificates of the next handshakes.
+func (r *Rotator) Rotate(ca *CA) {
+	// Namespaces are concatenated, so the one of the caller is kept
+	opts := append([]goproxy.TLSConfigOption{}, r.opts...)
+	opts = append(opts, goproxy.WithCertStorageNamespace(ca.Fingerprint()+":"))
+	tlsConfig := goproxy.TLSConfigFromCA(ca.TLSCertificate(), opts...)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.ca = ca
+	r.tlsConfig = tlsConfig
+}
+
+// TLSConfig is meant to be set as the TLSConfig of a ConnectAction.
+func (r *Rotator) TLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	r.mtx.RLock()
+	tlsConfig := r.tlsConfig
+	r.mtx.RUnlock()
+	return tlsConfig(host, ctx)
+}
@@ -0,0 +1,325 @@
+package goproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultCertRenewBefore is how long before their expiry the certificate
+// storages stop serving certificates, and generate them again.
+const DefaultCertRenewBefore = 24 * time.Hour
+
+// certFlights makes concurrent misses for the same hostname share a single
+// certificate generation.
+type certFlights struct {
+	mtx     sync.Mutex
+	flights map[string]*certFlight
+}
+
+var errCertFetchPanicked = errors.New("certificate generation panicked")
+
+type certFlight struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func (f *certFlights) do(hostname string, fetch func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	f.mtx.Lock()
+	if flight, ok := f.flights[hostname]; ok {
+		f.mtx.Unlock()
+		<-flight.done
+		return flight.cert, flight.err
+	}
+	if f.flights == nil {
+		f.flights = make(map[string]*certFlight)
+	}
+	// The error is kept if fetch panics, for the waiters not to block forever
+	flight := &certFlight{done: make(chan struct{}), err: errCertFetchPanicked}
+	f.flights[hostname] = flight
+	f.mtx.Unlock()
+
+	defer func() {
+		f.mtx.Lock()
+		delete(f.flights, hostname)
+		f.mtx.Unlock()
+		close(flight.done)
+	}()
+	flight.cert, flight.err = fetch()
+	return flight.cert, flight.err
+}
+
+// certExpiry returns the end of the validity of the leaf certificate of cert.
+func certExpiry(cert *tls.Certificate) (time.Time, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return time.Time{}, errors.New("empty certificate chain")
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return leaf.NotAfter, nil
+}
+
+func renewBefore(d time.Duration) time.Duration {
+	if d == 0 {
+		return DefaultCertRenewBefore
+	}
+	return d
+}
+
+// LRUCertStorage is a CertStorage keeping the most recently used
+// certificates in memory. Certificates are generated once for concurrent
+// handshakes with the same host, and generated again when they get close to
+// their expiry.
+type LRUCertStorage struct {
+	// RenewBefore is how long before their expiry certificates are generated
+	// again, DefaultCertRenewBefore when zero. Set it before use.
+	RenewBefore time.Duration
+	// Backend, when set, is where certificates missing from memory are
+	// fetched from, like a DiskCertStorage. Set it before use.
+	Backend CertStorage
+
+	maxEntries int
+	flights    certFlights
+
+	mtx     sync.Mutex
+	lru     *list.List // of *lruCert, most recently used first
+	entries map[string]*list.Element
+}
+
+type lruCert struct {
+	hostname string
+	cert     *tls.Certificate
+	expiry   time.Time
+}
+
+// NewLRUCertStorage creates an LRUCertStorage keeping at most maxEntries
+// certificates. When maxEntries is not positive, the storage is unbounded:
+// certificates are only removed when they get close to their expiry, or
+// with Remove and Purge.
+func NewLRUCertStorage(maxEntries int) *LRUCertStorage {
+	return &LRUCertStorage{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (s *LRUCertStorage) get(hostname string) *tls.Certificate {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	e, ok := s.entries[hostname]
+	if !ok {
+		return nil
+	}
+	c := e.Value.(*lruCert) //nolint:forcetypeassert
+	if time.Now().Add(renewBefore(s.RenewBefore)).After(c.expiry) {
+		s.lru.Remove(e)
+		delete(s.entries, hostname)
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return c.cert
+}
+
+func (s *LRUCertStorage) add(hostname string, cert *tls.Certificate, expiry time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if e, ok := s.entries[hostname]; ok {
+		s.lru.Remove(e)
+	}
+	s.entries[hostname] = s.lru.PushFront(&lruCert{hostname: hostname, cert: cert, expiry: expiry})
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruCert).hostname) //nolint:forcetypeassert
+	}
+}
+
+// Fetch implements CertStorage.
+func (s *LRUCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cert := s.get(hostname); cert != nil {
+		return cert, nil
+	}
+	return s.flights.do(hostname, func() (*tls.Certificate, error) {
+		var cert *tls.Certificate
+		var err error
+		if s.Backend != nil {
+			cert, err = s.Backend.Fetch(hostname, gen)
+		} else {
+			cert, err = gen()
+		}
+		if err != nil {
+			return nil, err
+		}
+		expiry, err := certExpiry(cert)
+		if err != nil {
+			return nil, err
+		}
+		s.add(hostname, cert, expiry)
+		return cert, nil
+	})
+}
+
+// Remove forgets the certificate of hostname, which is generated again on
+// the next handshake. It is not removed from the Backend.
+func (s *LRUCertStorage) Remove(hostname string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if e, ok := s.entries[hostname]; ok {
+		s.lru.Remove(e)
+		delete(s.entries, hostname)
+	}
+}
+
+// Purge forgets all the certificates. They are not removed from the Backend.
+func (s *LRUCertStorage) Purge() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lru.Init()
+	clear(s.entries)
+}
+
+// Len returns the number of certificates in memory.
+func (s *LRUCertStorage) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lru.Len()
+}
+
+// DiskCertStorage is a CertStorage keeping certificates in a directory, so
+// that they survive restarts. Certificates are stored along with their
+// private key in a subdirectory named after the fingerprint of the CA
+// signing them, so that changing the CA doesn't serve certificates it
+// didn't sign. Since certificates are read from disk on each handshake,
+// it is best used as the Backend of an LRUCertStorage.
+type DiskCertStorage struct {
+	// RenewBefore is how long before their expiry certificates are generated
+	// again, DefaultCertRenewBefore when zero. Set it before use.
+	RenewBefore time.Duration
+
+	dir     string
+	flights certFlights
+}
+
+// NewDiskCertStorage creates a DiskCertStorage for the certificates signed
+// by ca, in dir.
+func NewDiskCertStorage(dir string, ca *tls.Certificate) (*DiskCertStorage, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("empty CA certificate chain")
+	}
+	fingerprint := sha256.Sum256(ca.Certificate[0])
+	s := &DiskCertStorage{dir: filepath.Join(dir, hex.EncodeToString(fingerprint[:]))}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DiskCertStorage) path(hostname string) string {
+	// Hostnames may contain characters that are not allowed in file names
+	name := sha256.Sum256([]byte(hostname))
+	return filepath.Join(s.dir, hex.EncodeToString(name[:])+".pem")
+}
+
+func (s *DiskCertStorage) load(hostname string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(s.path(hostname))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := certExpiry(&cert)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Add(renewBefore(s.RenewBefore)).After(expiry) {
+		return nil, errors.New("certificate expires soon")
+	}
+	return &cert, nil
+}
+
+func (s *DiskCertStorage) store(hostname string, cert *tls.Certificate) error {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, der := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+
+	// Write to a temporary file first, so that a crash can't leave a
+	// truncated certificate behind
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(hostname))
+}
+
+// Fetch implements CertStorage. Certificates that can't be written to disk
+// are still returned, without any error: when the directory isn't writable,
+// nothing is persisted and certificates are generated on every call, so
+// check its permissions when using a DiskCertStorage.
+func (s *DiskCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	return s.flights.do(hostname, func() (*tls.Certificate, error) {
+		if cert, err := s.load(hostname); err == nil {
+			return cert, nil
+		}
+		cert, err := gen()
+		if err != nil {
+			return nil, err
+		}
+		_ = s.store(hostname, cert)
+		return cert, nil
+	})
+}
+
+// Remove deletes the certificate of hostname, which is generated again on
+// the next handshake.
+func (s *DiskCertStorage) Remove(hostname string) error {
+	err := os.Remove(s.path(hostname))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Purge deletes all the certificates signed by the CA of the storage.
+func (s *DiskCertStorage) Purge() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(s.dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
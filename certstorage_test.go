@@ -0,0 +1,235 @@
+package goproxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certGen returns a generator of self-signed certificates for host, valid
+// for the given duration, counting its calls.
+func certGen(t *testing.T, host string, validity time.Duration, calls *atomic.Int32) func() (*tls.Certificate, error) {
+	t.Helper()
+	return func() (*tls.Certificate, error) {
+		calls.Add(1)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: host},
+			DNSNames:     []string{host},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(validity),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+	}
+}
+
+func TestLRUCertStorage(t *testing.T) {
+	var calls atomic.Int32
+	storage := goproxy.NewLRUCertStorage(2)
+	for _, host := range []string{"a.example", "b.example", "a.example", "c.example"} {
+		_, err := storage.Fetch(host, certGen(t, host, 365*24*time.Hour, &calls))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), calls.Load(), "a.example should be cached")
+	assert.Equal(t, 2, storage.Len())
+
+	// b.example was the least recently used
+	_, err := storage.Fetch("a.example", certGen(t, "a.example", 365*24*time.Hour, &calls))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+	_, err = storage.Fetch("b.example", certGen(t, "b.example", 365*24*time.Hour, &calls))
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), calls.Load(), "b.example should have been evicted")
+
+	storage.Remove("b.example")
+	assert.Equal(t, 1, storage.Len())
+	storage.Purge()
+	assert.Zero(t, storage.Len())
+}
+
+func TestLRUCertStorageUnbounded(t *testing.T) {
+	var calls atomic.Int32
+	storage := goproxy.NewLRUCertStorage(0)
+	for _, host := range []string{"a.example", "b.example", "c.example", "a.example"} {
+		_, err := storage.Fetch(host, certGen(t, host, 365*24*time.Hour, &calls))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, 3, storage.Len())
+}
+
+func TestLRUCertStorageExpiry(t *testing.T) {
+	var calls atomic.Int32
+	storage := goproxy.NewLRUCertStorage(10)
+	gen := certGen(t, "a.example", time.Hour, &calls)
+	for i := 0; i < 2; i++ {
+		_, err := storage.Fetch("a.example", gen)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), calls.Load(), "certificates expiring soon should not be served")
+
+	storage.RenewBefore = time.Minute
+	_, err := storage.Fetch("a.example", gen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestLRUCertStorageSingleFlight(t *testing.T) {
+	var calls atomic.Int32
+	storage := goproxy.NewLRUCertStorage(10)
+	release := make(chan struct{})
+	gen := certGen(t, "a.example", 365*24*time.Hour, &calls)
+	slowGen := func() (*tls.Certificate, error) {
+		<-release
+		return gen()
+	}
+
+	var wg sync.WaitGroup
+	certs := make([]*tls.Certificate, 10)
+	for i := range certs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := storage.Fetch("a.example", slowGen)
+			assert.NoError(t, err)
+			certs[i] = cert
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for _, cert := range certs {
+		assert.Same(t, certs[0], cert)
+	}
+
+	// Errors are not cached
+	_, err := storage.Fetch("b.example", func() (*tls.Certificate, error) {
+		return nil, errors.New("boom")
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, storage.Len())
+}
+
+func TestLRUCertStoragePanickingGen(t *testing.T) {
+	storage := goproxy.NewLRUCertStorage(10)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { _ = recover() }()
+		_, _ = storage.Fetch("a.example", func() (*tls.Certificate, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := storage.Fetch("a.example", func() (*tls.Certificate, error) {
+			return nil, errors.New("not shared")
+		})
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	select {
+	case err := <-waited:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked by the panicking generation")
+	}
+
+	var calls atomic.Int32
+	_, err := storage.Fetch("a.example", certGen(t, "a.example", 365*24*time.Hour, &calls))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestDiskCertStorage(t *testing.T) {
+	dir := t.TempDir()
+	var calls atomic.Int32
+	gen := certGen(t, "a.example", 365*24*time.Hour, &calls)
+
+	storage, err := goproxy.NewDiskCertStorage(dir, &goproxy.GoproxyCa)
+	require.NoError(t, err)
+	first, err := storage.Fetch("a.example", gen)
+	require.NoError(t, err)
+
+	// Certificates survive restarts
+	storage, err = goproxy.NewDiskCertStorage(dir, &goproxy.GoproxyCa)
+	require.NoError(t, err)
+	loaded, err := storage.Fetch("a.example", gen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, first.Certificate, loaded.Certificate)
+	require.NotNil(t, loaded.Leaf)
+	assert.Equal(t, []string{"a.example"}, loaded.Leaf.DNSNames)
+
+	// Certificates of another CA are not served
+	var otherCalls atomic.Int32
+	otherCA, err := certGen(t, "ca.example", time.Hour, &otherCalls)()
+	require.NoError(t, err)
+	other, err := goproxy.NewDiskCertStorage(dir, otherCA)
+	require.NoError(t, err)
+	_, err = other.Fetch("a.example", gen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+
+	require.NoError(t, storage.Remove("a.example"))
+	_, err = storage.Fetch("a.example", gen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+
+	require.NoError(t, storage.Purge())
+	_, err = storage.Fetch("a.example", gen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), calls.Load())
+
+	// Certificates expiring soon are generated again
+	shortGen := certGen(t, "b.example", time.Hour, &calls)
+	_, err = storage.Fetch("b.example", shortGen)
+	require.NoError(t, err)
+	_, err = storage.Fetch("b.example", shortGen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(6), calls.Load())
+}
+
+func TestLRUCertStorageMitm(t *testing.T) {
+	backend, err := goproxy.NewDiskCertStorage(t.TempDir(), &goproxy.GoproxyCa)
+	require.NoError(t, err)
+	storage := goproxy.NewLRUCertStorage(100)
+	storage.Backend = backend
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = storage
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	assert.Equal(t, 1, storage.Len())
+}
@@ -6,6 +6,7 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"time"
 )
 
 // ProxyCtx is the Proxy context, contains useful information about every request. It is passed to
@@ -24,10 +25,40 @@ type ProxyCtx struct {
 	// A handle for the user to keep data in the context, from the call of ReqHandler to the
 	// call of RespHandler
 	UserData any
+	// Number of round trips made to the destination server for this request,
+	// greater than 1 when the request was retried (see ProxyHttpServer.Retry)
+	Attempts int
+	// Limit the bandwidth of the data sent to the destination server and to the client,
+	// covering request and response bodies, CONNECT tunnels and WebSocket connections.
+	// Requests of a MITM'd connection inherit the throttles of its CONNECT request.
+	UpstreamThrottle   Throttle
+	DownstreamThrottle Throttle
+	// Called once the tunnel of an accepted CONNECT request is closed, in both
+	// directions, with the number of bytes relayed. Set it from an HttpsHandler.
+	OnTunnelClose func(stats TunnelStats)
+	// ConnectReq is the CONNECT request of the MITM'd connection the request
+	// was read from, as received before the HttpsHandlers ran, nil for requests
+	// that weren't MITM'd. The CONNECT request carries the Proxy-Authorization
+	// header, which the requests don't.
+	ConnectReq *http.Request
 	// Will connect a request to a response
 	Session   int64
 	certStore CertStorage
 	Proxy     *ProxyHttpServer
+	// keyLogTransport replaces Proxy.Tr for the requests of a MITM'd
+	// connection when the secrets of its TLS connections are logged
+	keyLogTransport *http.Transport
+}
+
+// TunnelStats describes a CONNECT tunnel relayed without MITM.
+type TunnelStats struct {
+	// Host is the destination of the tunnel, with its port
+	Host       string
+	Start, End time.Time
+	// BytesSent were relayed from the client to the destination,
+	// BytesReceived from the destination to the client
+	BytesSent     int64
+	BytesReceived int64
 }
 
 type RoundTripper interface {
@@ -48,6 +79,9 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
+	if ctx.keyLogTransport != nil {
+		return ctx.keyLogTransport.RoundTrip(req)
+	}
 	return ctx.Proxy.Tr.RoundTrip(req)
 }
 
@@ -0,0 +1,250 @@
+package cache_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/cache"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// originHandler counts the requests reaching the origin server and lets
+// each test customize the response.
+type originHandler struct {
+	hits  atomic.Int32
+	serve func(w http.ResponseWriter, r *http.Request)
+}
+
+func (h *originHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.hits.Add(1)
+	h.serve(w, r)
+}
+
+func newCachingProxy(t *testing.T, c *cache.Cache) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(c.OnRequest)
+	proxy.OnResponse().DoFunc(c.OnResponse)
+	return proxytest.NewClient(t, proxy)
+}
+
+func TestFreshResponseIsServedFromCache(t *testing.T) {
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "artifact")
+	}}
+	for _, newServer := range []func(http.Handler) *httptest.Server{httptest.NewServer, httptest.NewTLSServer} {
+		background := newServer(origin)
+		origin.hits.Store(0)
+		client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0)))
+
+		_, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		assert.Equal(t, "artifact", body)
+		resp, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		assert.Equal(t, "artifact", body)
+		assert.Equal(t, "goproxy; hit", resp.Header.Get("Cache-Status"))
+		assert.Equal(t, int32(1), origin.hits.Load())
+		background.Close()
+	}
+}
+
+func TestStaleResponseIsRevalidated(t *testing.T) {
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = io.WriteString(w, "artifact")
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0)))
+
+	proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+	resp, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "artifact", body)
+	assert.Equal(t, "goproxy; fwd=stale; fwd-status=304", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, int32(2), origin.hits.Load())
+
+	// A client holding the current version gets a 304 from the cache
+	resp, _ = proxytest.Do(t, client, http.MethodGet, background.URL, "", http.Header{"If-None-Match": {`"v1"`}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func TestVaryingResponses(t *testing.T) {
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = io.WriteString(w, r.Header.Get("Accept-Language"))
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0)))
+
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		_, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", http.Header{"Accept-Language": {lang}})
+		assert.Equal(t, lang, body)
+	}
+	assert.Equal(t, int32(2), origin.hits.Load())
+}
+
+func TestRangeRequestOnCachedEntry(t *testing.T) {
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "0123456789")
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0)))
+
+	proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+	testCases := []struct {
+		rng    string
+		status int
+		body   string
+	}{
+		{"bytes=2-4", http.StatusPartialContent, "234"},
+		{"bytes=7-", http.StatusPartialContent, "789"},
+		{"bytes=-2", http.StatusPartialContent, "89"},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"bytes=0-1,4-5", http.StatusOK, "0123456789"},
+	}
+	for _, tc := range testCases {
+		resp, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", http.Header{"Range": {tc.rng}})
+		assert.Equal(t, tc.status, resp.StatusCode, tc.rng)
+		assert.Equal(t, tc.body, body, tc.rng)
+	}
+	assert.Equal(t, int32(1), origin.hits.Load())
+}
+
+func TestUncacheableResponses(t *testing.T) {
+	for _, cc := range []string{"no-store", "private, max-age=60", ""} {
+		origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cc)
+			_, _ = io.WriteString(w, "secret")
+		}}
+		background := httptest.NewServer(origin)
+		client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0)))
+
+		proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+		proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+		assert.Equal(t, int32(2), origin.hits.Load(), cc)
+		background.Close()
+	}
+}
+
+func TestStorages(t *testing.T) {
+	disk, err := cache.NewDiskStorage(t.TempDir())
+	require.NoError(t, err)
+	for name, storage := range map[string]cache.Storage{"memory": cache.NewMemoryStorage(0), "disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			_, ok := storage.Get("key")
+			assert.False(t, ok)
+			storage.Set("key", []byte("value"))
+			value, ok := storage.Get("key")
+			assert.True(t, ok)
+			assert.Equal(t, "value", string(value))
+			storage.Delete("key")
+			_, ok = storage.Get("key")
+			assert.False(t, ok)
+		})
+	}
+
+	lru := cache.NewMemoryStorage(10)
+	lru.Set("a", []byte("12345"))
+	lru.Set("b", []byte("12345"))
+	lru.Get("a")
+	lru.Set("c", []byte("12345"))
+	_, ok := lru.Get("b")
+	assert.False(t, ok, "least recently used value should be evicted")
+	_, ok = lru.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, lru.Len())
+}
+
+func TestStaleIfError(t *testing.T) {
+	testCases := []struct {
+		name      string
+		header    string
+		newServer func(http.Handler) *httptest.Server
+		policy    *cache.StalePolicy
+		// fail makes the origin fail with a 5xx instead of being shut down
+		fail bool
+	}{
+		{"directive and unreachable origin", "max-age=0, stale-if-error=60", httptest.NewServer, nil, false},
+		{"directive and mitm", "max-age=0, stale-if-error=60", httptest.NewTLSServer, nil, false},
+		{"directive and 5xx", "max-age=0, stale-if-error=60", httptest.NewServer, nil, true},
+		{"host policy", "max-age=0", httptest.NewServer, &cache.StalePolicy{StaleIfError: time.Minute}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var failing atomic.Bool
+			origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Header().Set("Cache-Control", tc.header)
+				_, _ = io.WriteString(w, "last good")
+			}}
+			background := tc.newServer(origin)
+			defer background.Close()
+
+			var opts []cache.Option
+			if tc.policy != nil {
+				u, _ := url.Parse(background.URL)
+				opts = append(opts,
+					cache.WithStalePolicy(cache.StalePolicy{}, goproxy.ReqHostIs("other.example")),
+					cache.WithStalePolicy(*tc.policy, goproxy.ReqHostIs(u.Host)))
+			}
+			client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0), opts...))
+
+			proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+			if tc.fail {
+				failing.Store(true)
+			} else {
+				background.Close()
+			}
+			resp, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "last good", body)
+			assert.Equal(t, `111 - "Revalidation Failed"`, resp.Header.Get("Warning"))
+			assert.NotEmpty(t, resp.Header.Get("Age"))
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int32
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = fmt.Fprintf(w, "v%d", version.Add(1))
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCachingProxy(t, cache.New(cache.NewMemoryStorage(0)))
+
+	_, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+	assert.Equal(t, "v1", body)
+	resp, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, `110 - "Response is Stale"`, resp.Header.Get("Warning"))
+
+	assert.Eventually(t, func() bool {
+		_, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+		return body == "v2"
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,406 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// DefaultCoalesceHeaders are the request headers that distinguish two
+// otherwise identical requests in the default key of a Coalescer.
+var DefaultCoalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// Coalescer implements collapsed forwarding: while a cacheable GET request
+// is being fetched from the destination server, identical requests wait for
+// its response instead of being forwarded too, then all receive a streamed
+// copy of it.
+//
+// Only responses that a shared cache could store are handed to the waiting
+// requests; for other responses, and when the response varies on a header
+// the requests don't agree on, each waiting request is forwarded on its own.
+//
+//	coalescer := cache.NewCoalescer()
+//	proxy.OnRequest().DoFunc(coalescer.OnRequest)
+//	proxy.OnResponse().DoFunc(coalescer.OnResponse)
+//
+// When used together with a Cache, register the Cache handlers first so that
+// fresh responses are still served from the cache.
+//
+// The shared response body is buffered up to a maximum size, see
+// WithMaxCollapsedSize, so that large responses don't hold memory for each
+// collapsed request.
+type Coalescer struct {
+	key     func(req *http.Request) string
+	maxWait time.Duration
+	maxSize int64
+	mtx     sync.Mutex
+	flights map[string]*collapsedFlight
+	leaders sync.Map // *goproxy.ProxyCtx -> *collapsedFlight
+}
+
+// CoalescerOption is a function type for configuring the Coalescer.
+type CoalescerOption func(*Coalescer)
+
+// WithCoalesceKey sets the function computing the key of a request: requests
+// with the same key are collapsed together. The default key is made of the
+// method, the URL and the DefaultCoalesceHeaders of the request.
+func WithCoalesceKey(key func(req *http.Request) string) CoalescerOption {
+	return func(c *Coalescer) {
+		c.key = key
+	}
+}
+
+// WithMaxWait sets how long a request waits for the response of an identical
+// in-flight request before being forwarded on its own. Defaults to 30s.
+func WithMaxWait(d time.Duration) CoalescerOption {
+	return func(c *Coalescer) {
+		c.maxWait = d
+	}
+}
+
+// WithMaxCollapsedSize sets how much of a shared response body is buffered.
+// Responses whose Content-Length exceeds size aren't shared. When a body of
+// unknown length exceeds size, no more requests are collapsed with it: the
+// requests already sharing it keep streaming it, the part that all of them
+// have read being dropped from the buffer, and the reading from the
+// destination server waiting for the slowest of them. Defaults to 32MB.
+func WithMaxCollapsedSize(size int64) CoalescerOption {
+	return func(c *Coalescer) {
+		c.maxSize = size
+	}
+}
+
+// NewCoalescer creates a Coalescer.
+func NewCoalescer(opts ...CoalescerOption) *Coalescer {
+	c := &Coalescer{
+		key:     DefaultCoalesceKey,
+		maxWait: 30 * time.Second,
+		maxSize: 32 << 20,
+		flights: make(map[string]*collapsedFlight),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// DefaultCoalesceKey is the default key function of a Coalescer.
+func DefaultCoalesceKey(req *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(req.Method)
+	sb.WriteString(" ")
+	sb.WriteString(primaryKey(req.URL))
+	for _, h := range DefaultCoalesceHeaders {
+		sb.WriteString("\x00")
+		sb.WriteString(strings.Join(req.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+// collapsedFlight is an upstream request shared by several clients.
+type collapsedFlight struct {
+	key    string
+	req    *http.Request
+	ready  chan struct{}
+	once   sync.Once
+	resp   *http.Response
+	shared *sharedBody
+}
+
+// publish makes the upstream response available to the waiting requests.
+// A nil resp means they have to be forwarded on their own.
+func (f *collapsedFlight) publish(resp *http.Response, shared *sharedBody) {
+	f.once.Do(func() {
+		f.resp, f.shared = resp, shared
+		close(f.ready)
+	})
+}
+
+// OnRequest either makes req the leader of a new flight, or waits for the
+// response of the in-flight identical request.
+func (c *Coalescer) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" ||
+		(req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0) {
+		return req, nil
+	}
+	key := c.key(req)
+
+	c.mtx.Lock()
+	f, inFlight := c.flights[key]
+	if !inFlight {
+		f = &collapsedFlight{key: key, req: req, ready: make(chan struct{})}
+		c.flights[key] = f
+	}
+	c.mtx.Unlock()
+
+	if !inFlight {
+		c.lead(ctx, f)
+		return req, nil
+	}
+
+	timer := time.NewTimer(c.maxWait)
+	defer timer.Stop()
+	select {
+	case <-f.ready:
+	case <-timer.C:
+		ctx.Logf("Gave up waiting for in-flight request to %v", req.URL)
+		return req, nil
+	case <-req.Context().Done():
+		return req, nil
+	}
+	if f.resp == nil || !sameVariant(f.resp.Header, f.req.Header, req.Header) {
+		return req, nil
+	}
+	body, ok := f.shared.reader()
+	if !ok {
+		// The response is too large to be buffered, or was abandoned
+		return req, nil
+	}
+	ctx.Logf("Collapsed request to %v with in-flight request", req.URL)
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Header.Set("Cache-Status", "goproxy; fwd=uri-miss; collapsed")
+	resp.Request = req
+	resp.Body = body
+	return nil, &resp
+}
+
+// lead wraps the RoundTripper of the leader request, so that its response
+// is shared with the requests waiting for it.
+func (c *Coalescer) lead(ctx *goproxy.ProxyCtx, f *collapsedFlight) {
+	c.leaders.Store(ctx, f)
+	next := ctx.RoundTripper
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		if next != nil {
+			resp, err = next.RoundTrip(req, ctx)
+		} else {
+			// Round trip like the proxy would have without this RoundTripper
+			inner := *ctx
+			inner.RoundTripper = nil
+			resp, err = inner.RoundTrip(req)
+		}
+		if err != nil || !storable(req, resp) || resp.ContentLength > c.maxSize {
+			c.finish(f, nil, nil)
+			return resp, err
+		}
+
+		shared := newSharedBody(resp.Body, c.maxSize, func() {
+			// Later identical requests are forwarded on their own
+			c.finish(f, nil, nil)
+		})
+		leaderResp := *resp
+		leaderResp.Body, _ = shared.reader()
+		go func() {
+			shared.fill()
+			c.finish(f, nil, nil)
+		}()
+		c.finish(f, resp, shared)
+		return &leaderResp, nil
+	})
+}
+
+// finish publishes the outcome of a flight. The flight is forgotten once its
+// response body has been entirely received, or right away when it failed.
+func (c *Coalescer) finish(f *collapsedFlight, resp *http.Response, shared *sharedBody) {
+	f.publish(resp, shared)
+	if resp != nil {
+		return
+	}
+	c.mtx.Lock()
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	c.mtx.Unlock()
+}
+
+// OnResponse releases the requests waiting on a leader whose request never
+// reached the destination server, for example because another handler
+// answered it.
+func (c *Coalescer) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if v, ok := c.leaders.LoadAndDelete(ctx); ok {
+		f := v.(*collapsedFlight) //nolint:forcetypeassert
+		select {
+		case <-f.ready:
+		default:
+			c.finish(f, nil, nil)
+		}
+	}
+	return resp
+}
+
+// sameVariant reports whether a response to leaderHeader may be used for a
+// request with header, given the request headers the response varies on.
+func sameVariant(respHeader, leaderHeader, header http.Header) bool {
+	for _, name := range varyNames(respHeader) {
+		if name == "*" || strings.Join(leaderHeader.Values(name), ",") != strings.Join(header.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedBody buffers a response body so that it can be read by several
+// clients, each at its own pace.
+//
+// Once the buffer exceeds its maximum size, or once all its readers are
+// closed, the body is sealed: no reader can be added anymore, and the part of
+// the buffer read by all the readers is dropped.
+type sharedBody struct {
+	body   io.ReadCloser
+	max    int64
+	onSeal func()
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	base    int64 // offset of buf in the body
+	readers map[*sharedReader]struct{}
+	sealed  bool
+	done    bool
+	err     error
+}
+
+func newSharedBody(body io.ReadCloser, maxSize int64, onSeal func()) *sharedBody {
+	s := &sharedBody{body: body, max: maxSize, onSeal: onSeal, readers: make(map[*sharedReader]struct{})}
+	s.cond = sync.NewCond(&s.mtx)
+	return s
+}
+
+// fill reads the body into the buffer until its end, or until all the
+// readers are closed.
+func (s *sharedBody) fill() {
+	defer s.body.Close()
+	chunk := make([]byte, 32*1024)
+	for {
+		s.mtx.Lock()
+		for s.sealed && !s.done && int64(len(s.buf)) >= s.max {
+			s.cond.Wait()
+		}
+		done := s.done
+		s.mtx.Unlock()
+		if done {
+			return
+		}
+
+		n, err := s.body.Read(chunk)
+		s.mtx.Lock()
+		if s.done {
+			s.mtx.Unlock()
+			return
+		}
+		s.buf = append(s.buf, chunk[:n]...)
+		seal := !s.sealed && int64(len(s.buf)) > s.max
+		if seal {
+			s.sealed = true
+		}
+		s.trim()
+		if err != nil {
+			s.done = true
+			if err != io.EOF { //nolint:errorlint
+				s.err = err
+			}
+		}
+		s.cond.Broadcast()
+		s.mtx.Unlock()
+		if seal {
+			s.onSeal()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// trim drops the part of the buffer of a sealed body read by all the readers.
+// It must be called with s.mtx held.
+func (s *sharedBody) trim() {
+	if !s.sealed || len(s.readers) == 0 {
+		return
+	}
+	minOff := s.base + int64(len(s.buf))
+	for r := range s.readers {
+		minOff = min(minOff, r.off)
+	}
+	s.buf = s.buf[minOff-s.base:]
+	s.base = minOff
+}
+
+// reader returns a new reader of the body, or false if the body is sealed.
+func (s *sharedBody) reader() (io.ReadCloser, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.sealed {
+		return nil, false
+	}
+	r := &sharedReader{shared: s}
+	s.readers[r] = struct{}{}
+	return r, true
+}
+
+type sharedReader struct {
+	shared *sharedBody
+	off    int64
+	closed bool
+}
+
+func (r *sharedReader) Read(p []byte) (int, error) {
+	s := r.shared
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for r.off == s.base+int64(len(s.buf)) && !s.done && !r.closed {
+		s.cond.Wait()
+	}
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if r.off == s.base+int64(len(s.buf)) {
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[r.off-s.base:])
+	r.off += int64(n)
+	if s.sealed {
+		// Make room for fill
+		s.trim()
+		s.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// Close removes the reader. Once all the readers are closed, the body is no
+// longer read from the destination server.
+func (r *sharedReader) Close() error {
+	s := r.shared
+	s.mtx.Lock()
+	if r.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	r.closed = true
+	delete(s.readers, r)
+	abandoned := len(s.readers) == 0 && !s.done
+	seal := abandoned && !s.sealed
+	if abandoned {
+		s.sealed, s.done, s.err = true, true, io.ErrClosedPipe
+		s.buf = nil
+	}
+	s.trim()
+	s.cond.Broadcast()
+	s.mtx.Unlock()
+	if abandoned {
+		// Interrupt the ongoing read of fill
+		_ = s.body.Close()
+	}
+	if seal {
+		s.onSeal()
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package cache_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/cache"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCoalescingProxy(t *testing.T, c *cache.Coalescer) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(c.OnRequest)
+	proxy.OnResponse().DoFunc(c.OnResponse)
+	return proxytest.NewClient(t, proxy)
+}
+
+// countArrivals returns a key function counting the requests reaching the
+// Coalescer, and a function blocking until n of them arrived, for the origin
+// to answer once they are all pending.
+func countArrivals(n int, key func(req *http.Request) string) (func(req *http.Request) string, func()) {
+	arrived := make(chan struct{}, n)
+	var once sync.Once
+	counting := func(req *http.Request) string {
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		return key(req)
+	}
+	wait := func() {
+		once.Do(func() {
+			for range n {
+				<-arrived
+			}
+		})
+	}
+	return counting, wait
+}
+
+func TestCoalescer(t *testing.T) {
+	testCases := []struct {
+		name      string
+		header    string
+		newServer func(http.Handler) *httptest.Server
+		hits      int32
+	}{
+		{"cacheable", "max-age=60", httptest.NewServer, 1},
+		{"cacheable mitm", "max-age=60", httptest.NewTLSServer, 1},
+		{"uncacheable", "no-store", httptest.NewServer, 10},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, wait := countArrivals(10, cache.DefaultCoalesceKey)
+			origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+				wait()
+				w.Header().Set("Cache-Control", tc.header)
+				_, _ = io.WriteString(w, "build image")
+			}}
+			background := tc.newServer(origin)
+			defer background.Close()
+			client := newCoalescingProxy(t, cache.NewCoalescer(cache.WithCoalesceKey(key)))
+
+			var wg sync.WaitGroup
+			for range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/image", "", nil)
+					assert.Equal(t, "build image", body)
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, tc.hits, origin.hits.Load())
+		})
+	}
+}
+
+func TestCoalescerKeyFunc(t *testing.T) {
+	// Ignore the query string, so that all the requests share a key
+	key, wait := countArrivals(3, func(req *http.Request) string {
+		return req.URL.Path
+	})
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		wait()
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "build image")
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCoalescingProxy(t, cache.NewCoalescer(cache.WithCoalesceKey(key)))
+
+	var wg sync.WaitGroup
+	for _, query := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxytest.Do(t, client, http.MethodGet, background.URL+"/image?"+query, "", nil)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), origin.hits.Load())
+}
+
+func TestCoalescerMaxCollapsedSize(t *testing.T) {
+	key, wait := countArrivals(3, cache.DefaultCoalesceKey)
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		wait()
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "build image")
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCoalescingProxy(t, cache.NewCoalescer(cache.WithCoalesceKey(key), cache.WithMaxCollapsedSize(4)))
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/image", "", nil)
+			assert.Equal(t, "build image", body)
+		}()
+	}
+	wg.Wait()
+	// The Content-Length of the response exceeds the maximum size
+	assert.Equal(t, int32(3), origin.hits.Load())
+}
+
+func TestCoalescerStreamsLargeBodies(t *testing.T) {
+	image := bytes.Repeat([]byte("build image "), 100_000)
+	key, wait := countArrivals(5, cache.DefaultCoalesceKey)
+	origin := &originHandler{serve: func(w http.ResponseWriter, r *http.Request) {
+		wait()
+		w.Header().Set("Cache-Control", "max-age=60")
+		// Without Content-Length, the body is shared until it exceeds the
+		// maximum size
+		for chunk := range slices.Chunk(image, 16*1024) {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}}
+	background := httptest.NewServer(origin)
+	defer background.Close()
+	client := newCoalescingProxy(t, cache.NewCoalescer(cache.WithCoalesceKey(key), cache.WithMaxCollapsedSize(64*1024)))
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/image", "", nil)
+			assert.Equal(t, string(image), body)
+		}()
+	}
+	wg.Wait()
+	assert.Positive(t, origin.hits.Load())
+}
+
+func TestCoalescerStopsReadingAbandonedBodies(t *testing.T) {
+	canceled := make(chan bool, 1)
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "build image")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	})
+	background := httptest.NewServer(origin)
+	defer background.Close()
+
+	coalescer := cache.NewCoalescer()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(coalescer.OnRequest)
+	proxy.OnResponse().DoFunc(coalescer.OnResponse)
+	// Replace the shared response, closing its only reader
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		_ = resp.Body.Close()
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusOK, "replaced")
+	})
+	client := proxytest.NewClient(t, proxy)
+
+	_, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/image", "", nil)
+	assert.Equal(t, "replaced", body)
+	assert.True(t, <-canceled, "the body should no longer be read from the origin")
+}
+
+// lockedBuffer is written by the proxy while the test reads it.
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestCoalescerLeaderUsesProxyRoundTrip(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	// The secrets of the connections to the origin are only logged by the
+	// transport of the MITM'd connection
+	var keyLog lockedBuffer
+	c := cache.NewCoalescer()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.KeyLogWriter = &keyLog
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(c.OnRequest)
+	proxy.OnResponse().DoFunc(c.OnResponse)
+	client := proxytest.NewClient(t, proxy)
+
+	_, body := proxytest.Do(t, client, http.MethodGet, origin.URL, "", nil)
+	assert.Equal(t, "ok", body)
+	assert.Contains(t, keyLog.String(), "upstream handshake", "upstream secrets should be logged")
+}
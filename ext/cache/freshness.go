@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the parsed directives of a Cache-Control header.
+// Directives without argument are mapped to the empty string.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// duration returns the delta-seconds argument of directive.
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func parseHTTPDate(h http.Header, name string) (time.Time, bool) {
+	v := h.Get(name)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// heuristicallyCacheable lists the status codes that may be cached without
+// explicit freshness information (RFC 9110, Section 15.1).
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// freshnessLifetime computes how long a response stays fresh in a shared
+// cache (RFC 9111, Section 4.2.1).
+func (c *Cache) freshnessLifetime(e *entry) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+	if expires, ok := parseHTTPDate(e.Header, "Expires"); ok {
+		date, ok := parseHTTPDate(e.Header, "Date")
+		if !ok {
+			date = e.ResponseTime
+		}
+		return max(expires.Sub(date), 0)
+	}
+	if e.Header.Get("Expires") != "" {
+		// An invalid Expires value means the response is already expired
+		return 0
+	}
+	if !heuristicallyCacheable[e.StatusCode] && !cc.has("public") {
+		return 0
+	}
+	// Heuristic freshness: a fraction of the time since the last modification
+	lastModified, ok := parseHTTPDate(e.Header, "Last-Modified")
+	if !ok {
+		return 0
+	}
+	date, ok := parseHTTPDate(e.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	return min(date.Sub(lastModified)/10, c.maxHeuristic)
+}
+
+// currentAge computes the age of a stored response (RFC 9111, Section 4.2.3).
+func currentAge(e *entry, now time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, ok := parseHTTPDate(e.Header, "Date"); ok {
+		apparentAge = max(e.ResponseTime.Sub(date), 0)
+	}
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// storable reports whether a response to req may be stored by a shared
+// cache (RFC 9111, Section 3).
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	// Cookies are specific to a client and must not leak through a shared cache
+	if resp.Header.Get("Set-Cookie") != "" && !respCC.has("public") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	return respCC.has("public") || respCC.has("max-age") || respCC.has("s-maxage") ||
+		resp.Header.Get("Expires") != "" ||
+		(heuristicallyCacheable[resp.StatusCode] && resp.Header.Get("Last-Modified") != "") ||
+		respCC.has("no-cache") && (resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "")
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage persists encoded cache entries under string keys.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the value stored under key, if any.
+	Get(key string) ([]byte, bool)
+	// Set stores value under key, replacing any previous value.
+	Set(key string, value []byte)
+	// Delete removes the value stored under key, if any.
+	Delete(key string)
+}
+
+// MemoryStorage is an in-memory Storage that evicts the least recently used
+// entries once the total size of the stored values exceeds its capacity.
+type MemoryStorage struct {
+	maxBytes int64
+	size     int64
+	mtx      sync.Mutex
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	value []byte
+}
+
+// NewMemoryStorage creates a MemoryStorage holding at most maxBytes of values.
+// A maxBytes lower or equal to zero means no limit.
+func NewMemoryStorage(maxBytes int64) *MemoryStorage {
+	return &MemoryStorage{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStorage) Get(key string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*memoryItem).value, true //nolint:forcetypeassert
+}
+
+func (s *MemoryStorage) Set(key string, value []byte) {
+	if s.maxBytes > 0 && int64(len(value)) > s.maxBytes {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, value: value})
+	s.size += int64(len(value))
+	for s.maxBytes > 0 && s.size > s.maxBytes {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *MemoryStorage) Delete(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+}
+
+// Len returns the number of stored values.
+func (s *MemoryStorage) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lru.Len()
+}
+
+func (s *MemoryStorage) removeElement(e *list.Element) {
+	item := s.lru.Remove(e).(*memoryItem) //nolint:forcetypeassert
+	delete(s.items, item.key)
+	s.size -= int64(len(item.value))
+}
+
+// DiskStorage is a Storage keeping every value in its own file inside a
+// directory, so that the cache survives restarts of the proxy.
+// It doesn't evict anything by itself: old files can be removed at any
+// time by an external job.
+type DiskStorage struct {
+	dir string
+}
+
+// NewDiskStorage creates a DiskStorage writing into dir, creating it if needed.
+func NewDiskStorage(dir string) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskStorage{dir: dir}, nil
+}
+
+func (s *DiskStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *DiskStorage) Get(key string) ([]byte, bool) {
+	value, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *DiskStorage) Set(key string, value []byte) {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return
+	}
+	// Write to a temporary file first, so that readers never see
+	// a partially written value.
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+}
+
+func (s *DiskStorage) Delete(key string) {
+	_ = os.Remove(s.path(key))
+}
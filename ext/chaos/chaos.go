@@ -0,0 +1,297 @@
+// Package chaos injects faults into the traffic going through a goproxy
+// proxy, to test how clients cope with slow, failing or flaky servers.
+//
+// Faults are added to an Injector with a probability and the conditions the
+// request must match, then the Injector handlers are registered on the proxy:
+//
+//	injector := chaos.New(chaos.WithReporter(func(f chaos.Fault) { faults = append(faults, f) }))
+//	injector.AddLatency(0.2, 100*time.Millisecond, time.Second)
+//	injector.AddStatus(0.05, http.StatusServiceUnavailable, goproxy.ReqHostIs("api.example"))
+//	proxy.OnRequest().HandleConnect(injector)
+//	proxy.OnRequest().DoFunc(injector.OnRequest)
+//	proxy.OnResponse().DoFunc(injector.OnResponse)
+//
+// Every injected fault is logged with ctx.Warnf, along with the session of the
+// request, and passed to the reporter so that test failures can be correlated
+// with the faults that caused them.
+package chaos
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Kind is the kind of a fault.
+type Kind string
+
+const (
+	// Latency delays the request before forwarding it.
+	Latency Kind = "latency"
+	// Status answers the request with a synthetic response.
+	Status Kind = "status"
+	// Reset breaks the connection to the client in the middle of the response body.
+	Reset Kind = "reset"
+	// Truncate ends the response body early, as if it was complete.
+	Truncate Kind = "truncate"
+	// HandshakeDelay delays the TLS handshake of a MITM'd connection.
+	HandshakeDelay Kind = "handshake-delay"
+	// RefuseConnect closes the client connection instead of accepting its CONNECT request.
+	RefuseConnect Kind = "refuse-connect"
+)
+
+// ErrInjectedReset is the error returned by response bodies reset by a Reset fault.
+var ErrInjectedReset = errors.New("chaos: injected connection reset")
+
+// Fault describes a fault injected into the traffic.
+type Fault struct {
+	// Session of the ProxyCtx of the faulty request
+	Session int64
+	Kind    Kind
+	URL     string
+	Time    time.Time
+}
+
+type rule struct {
+	kind        Kind
+	probability float64
+	conds       []goproxy.ReqCondition
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	status      int
+	after       int64
+}
+
+// Injector injects the faults it has been configured with.
+// Faults should be added before the proxy starts serving requests.
+type Injector struct {
+	rules    []rule
+	reporter func(Fault)
+	mitm     *goproxy.ConnectAction
+
+	mtx  sync.Mutex
+	rand *rand.Rand
+}
+
+// Option is a function type for configuring the Injector.
+type Option func(*Injector)
+
+// WithReporter sets a function called for every injected fault.
+func WithReporter(reporter func(Fault)) Option {
+	return func(in *Injector) {
+		in.reporter = reporter
+	}
+}
+
+// WithSeed makes the injected faults reproducible, by seeding the random
+// numbers deciding whether a fault applies.
+func WithSeed(seed uint64) Option {
+	return func(in *Injector) {
+		in.rand = rand.New(rand.NewPCG(seed, seed)) //nolint:gosec
+	}
+}
+
+// WithMitmAction sets the action used to MITM the connections that get a
+// HandshakeDelay fault. Defaults to goproxy.MitmConnect.
+func WithMitmAction(action *goproxy.ConnectAction) Option {
+	return func(in *Injector) {
+		in.mitm = action
+	}
+}
+
+// New creates an Injector, without any fault.
+func New(opts ...Option) *Injector {
+	in := &Injector{
+		mitm: goproxy.MitmConnect,
+		rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())), //nolint:gosec
+	}
+	for _, opt := range opts {
+		opt(in)
+	}
+	return in
+}
+
+// AddLatency delays the matching requests by a random duration between min and max.
+func (in *Injector) AddLatency(probability float64, minDelay, maxDelay time.Duration, conds ...goproxy.ReqCondition) {
+	in.rules = append(in.rules, rule{kind: Latency, probability: probability, conds: conds, minDelay: minDelay, maxDelay: maxDelay})
+}
+
+// AddStatus answers the matching requests with an empty response of the given status.
+func (in *Injector) AddStatus(probability float64, status int, conds ...goproxy.ReqCondition) {
+	in.rules = append(in.rules, rule{kind: Status, probability: probability, conds: conds, status: status})
+}
+
+// AddReset breaks the connection to the client after sending the first
+// after bytes of the response body of the matching requests.
+func (in *Injector) AddReset(probability float64, after int64, conds ...goproxy.ReqCondition) {
+	in.rules = append(in.rules, rule{kind: Reset, probability: probability, conds: conds, after: after})
+}
+
+// AddTruncate ends the response body of the matching requests after its first after bytes.
+func (in *Injector) AddTruncate(probability float64, after int64, conds ...goproxy.ReqCondition) {
+	in.rules = append(in.rules, rule{kind: Truncate, probability: probability, conds: conds, after: after})
+}
+
+// AddHandshakeDelay MITMs the matching CONNECT requests and delays their TLS handshake.
+func (in *Injector) AddHandshakeDelay(probability float64, delay time.Duration, conds ...goproxy.ReqCondition) {
+	in.rules = append(in.rules, rule{kind: HandshakeDelay, probability: probability, conds: conds, minDelay: delay, maxDelay: delay})
+}
+
+// AddRefuseConnect closes the client connection of the matching CONNECT requests.
+func (in *Injector) AddRefuseConnect(probability float64, conds ...goproxy.ReqCondition) {
+	in.rules = append(in.rules, rule{kind: RefuseConnect, probability: probability, conds: conds})
+}
+
+// roll returns the first rule of kind applying to req.
+func (in *Injector) roll(kind Kind, req *http.Request, ctx *goproxy.ProxyCtx) (rule, bool) {
+	for _, r := range in.rules {
+		if r.kind != kind || !matches(r.conds, req, ctx) {
+			continue
+		}
+		in.mtx.Lock()
+		n := in.rand.Float64()
+		in.mtx.Unlock()
+		if n < r.probability {
+			return r, true
+		}
+	}
+	return rule{}, false
+}
+
+func matches(conds []goproxy.ReqCondition, req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	for _, cond := range conds {
+		if !cond.HandleReq(req, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r rule) delay(n float64) time.Duration {
+	return r.minDelay + time.Duration(n*float64(r.maxDelay-r.minDelay))
+}
+
+func (in *Injector) report(kind Kind, target string, ctx *goproxy.ProxyCtx) {
+	ctx.Warnf("chaos: injecting %s fault into %s", kind, target)
+	if in.reporter != nil {
+		in.reporter(Fault{Session: ctx.Session, Kind: kind, URL: target, Time: time.Now()})
+	}
+}
+
+// OnRequest injects the Latency and Status faults.
+func (in *Injector) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r, ok := in.roll(Latency, req, ctx); ok {
+		in.mtx.Lock()
+		d := r.delay(in.rand.Float64())
+		in.mtx.Unlock()
+		in.report(Latency, req.URL.String(), ctx)
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+		}
+	}
+	if r, ok := in.roll(Status, req, ctx); ok {
+		in.report(Status, req.URL.String(), ctx)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, r.status, "")
+	}
+	return req, nil
+}
+
+// OnResponse injects the Reset and Truncate faults.
+func (in *Injector) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp
+	}
+	for _, kind := range []Kind{Reset, Truncate} {
+		r, ok := in.roll(kind, ctx.Req, ctx)
+		if !ok {
+			continue
+		}
+		in.report(kind, ctx.Req.URL.String(), ctx)
+		end := error(io.EOF)
+		if kind == Reset {
+			end = ErrInjectedReset
+		}
+		resp.Body = &faultyBody{ReadCloser: resp.Body, remaining: r.after, err: end}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		break
+	}
+	return resp
+}
+
+// HandleConnect implements goproxy.HttpsHandler, injecting the RefuseConnect
+// and HandshakeDelay faults. The other CONNECT requests are left to the next handlers.
+func (in *Injector) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if _, ok := in.roll(RefuseConnect, ctx.Req, ctx); ok {
+		in.report(RefuseConnect, host, ctx)
+		return goproxy.RejectConnect, host
+	}
+	if r, ok := in.roll(HandshakeDelay, ctx.Req, ctx); ok {
+		in.report(HandshakeDelay, host, ctx)
+		action := *in.mitm
+		if action.TLSConfig == nil {
+			action.TLSConfig = goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+		}
+		action.TLSConfig = delayHandshake(action.TLSConfig, r.minDelay)
+		return &action, host
+	}
+	return nil, host
+}
+
+// delayHandshake wraps the TLS configuration of a ConnectAction so that the
+// server side of the handshake waits for delay before answering the client.
+func delayHandshake(
+	tlsConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error),
+	delay time.Duration,
+) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := tlsConfig(host, ctx)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		getConfigForClient := config.GetConfigForClient
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-hello.Context().Done():
+				return nil, hello.Context().Err()
+			}
+			if getConfigForClient != nil {
+				return getConfigForClient(hello)
+			}
+			return nil, nil
+		}
+		return config, nil
+	}
+}
+
+// faultyBody returns err after remaining bytes.
+type faultyBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
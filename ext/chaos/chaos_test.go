@@ -0,0 +1,152 @@
+package chaos_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/chaos"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	mtx    sync.Mutex
+	faults []chaos.Fault
+}
+
+func (r *recorder) report(f chaos.Fault) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.faults = append(r.faults, f)
+}
+
+func (r *recorder) kinds() []chaos.Kind {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var kinds []chaos.Kind
+	for _, f := range r.faults {
+		kinds = append(kinds, f.Kind)
+	}
+	return kinds
+}
+
+func newChaosProxy(t *testing.T, configure func(in *chaos.Injector)) (*http.Client, *recorder) {
+	t.Helper()
+	rec := &recorder{}
+	in := chaos.New(chaos.WithReporter(rec.report))
+	configure(in)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(in)
+	proxy.OnRequest().DoFunc(in.OnRequest)
+	proxy.OnResponse().DoFunc(in.OnResponse)
+	return proxytest.NewClient(t, proxy), rec
+}
+
+func get(client *http.Client, target string) (*http.Response, string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, string(body), err
+}
+
+func TestFaults(t *testing.T) {
+	payload := strings.Repeat("0123456789", 10000)
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer background.Close()
+
+	t.Run("latency", func(t *testing.T) {
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddLatency(1, 200*time.Millisecond, 200*time.Millisecond)
+		})
+		start := time.Now()
+		_, body, err := get(client, background.URL)
+		require.NoError(t, err)
+		assert.Equal(t, payload, body)
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+		assert.Equal(t, []chaos.Kind{chaos.Latency}, rec.kinds())
+	})
+
+	t.Run("status", func(t *testing.T) {
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddStatus(1, http.StatusServiceUnavailable, goproxy.UrlHasPrefix("127.0.0.1"))
+			in.AddStatus(1, http.StatusTeapot, goproxy.UrlHasPrefix("other.example"))
+		})
+		resp, _, err := get(client, background.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, []chaos.Kind{chaos.Status}, rec.kinds())
+	})
+
+	t.Run("never", func(t *testing.T) {
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddStatus(0, http.StatusServiceUnavailable)
+		})
+		resp, _, err := get(client, background.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, rec.kinds())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddReset(1, 50000)
+		})
+		_, body, err := get(client, background.URL)
+		require.Error(t, err)
+		assert.Less(t, len(body), len(payload))
+		assert.Equal(t, []chaos.Kind{chaos.Reset}, rec.kinds())
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddTruncate(1, 10)
+		})
+		_, body, err := get(client, background.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "0123456789", body)
+		assert.Equal(t, []chaos.Kind{chaos.Truncate}, rec.kinds())
+	})
+
+	t.Run("refuse connect", func(t *testing.T) {
+		tlsBackground := httptest.NewTLSServer(background.Config.Handler)
+		defer tlsBackground.Close()
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddRefuseConnect(1)
+		})
+		_, _, err := get(client, tlsBackground.URL)
+		require.Error(t, err)
+		assert.Equal(t, []chaos.Kind{chaos.RefuseConnect}, rec.kinds())
+	})
+
+	t.Run("handshake delay", func(t *testing.T) {
+		tlsBackground := httptest.NewTLSServer(background.Config.Handler)
+		defer tlsBackground.Close()
+		client, rec := newChaosProxy(t, func(in *chaos.Injector) {
+			in.AddHandshakeDelay(1, 200*time.Millisecond)
+		})
+		start := time.Now()
+		_, body, err := get(client, tlsBackground.URL)
+		require.NoError(t, err)
+		assert.Equal(t, payload, body)
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+		assert.Equal(t, []chaos.Kind{chaos.HandshakeDelay}, rec.kinds())
+	})
+}
@@ -5,8 +5,8 @@ go 1.23.0
 require (
 	github.com/elazarl/goproxy v0.0.0-20241217120900-7711dfa3811c
 	github.com/stretchr/testify v1.11.1
-	golang.org/x/net v0.36.0
-	golang.org/x/text v0.22.0
+	golang.org/x/net v0.43.0
+	golang.org/x/text v0.28.0
 )
 
 require (
@@ -14,3 +14,5 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/elazarl/goproxy => ../
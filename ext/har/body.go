@@ -0,0 +1,165 @@
+package har
+
+import (
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "net/url"
+    "sync"
+    "unicode/utf8"
+)
+
+// bodyCapture keeps the beginning of a body, up to max bytes when max is
+// positive, and counts its total size.
+type bodyCapture struct {
+    max  int64
+    mtx  sync.Mutex
+    buf  bytes.Buffer
+    size int64
+}
+
+func newBodyCapture(max int64) *bodyCapture {
+    return &bodyCapture{max: max}
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+    c.size += int64(len(p))
+    keep := p
+    if c.max > 0 {
+        room := c.max - int64(c.buf.Len())
+        if room < int64(len(keep)) {
+            keep = keep[:max(room, 0)]
+        }
+    }
+    c.buf.Write(keep)
+    return len(p), nil
+}
+
+// text returns the captured bytes as HAR text, base64 encoded when they are
+// not text, and a comment when they have been truncated.
+func (c *bodyCapture) text() (text, encoding, comment string) {
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+    data := c.buf.Bytes()
+    truncated := int64(len(data)) < c.size
+    if truncated {
+        comment = fmt.Sprintf("truncated to %d of %d bytes", len(data), c.size)
+        // The cap may cut the last character of a text in half
+        if i := lastRuneStart(data); !utf8.FullRune(data[i:]) {
+            data = data[:i]
+        }
+    }
+    if utf8.Valid(data) && !bytes.ContainsRune(data, 0) {
+        return string(data), "", comment
+    }
+    return base64.StdEncoding.EncodeToString(c.buf.Bytes()), "base64", comment
+}
+
+func lastRuneStart(data []byte) int {
+    for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+        if utf8.RuneStart(data[i]) {
+            return i
+        }
+    }
+    return len(data)
+}
+
+func (c *bodyCapture) content(mimeType string) Content {
+    text, encoding, comment := c.text()
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+    return Content{
+        Size:     int(c.size),
+        MimeType: mimeType,
+        Text:     text,
+        Encoding: encoding,
+        Comment:  comment,
+    }
+}
+
+func (c *bodyCapture) postData(mimeType string) *PostData {
+    text, encoding, comment := c.text()
+    postData := &PostData{
+        MimeType: mimeType,
+        Encoding: encoding,
+        Comment:  comment,
+    }
+    if mimeType == "application/x-www-form-urlencoded" && encoding == "" && comment == "" {
+        if values, err := url.ParseQuery(text); err == nil {
+            for k, vals := range values {
+                for _, v := range vals {
+                    postData.Params = append(postData.Params, PostDataParam{Name: k, Value: v})
+                }
+            }
+        }
+    }
+    if len(postData.Params) == 0 {
+        postData.Text = text
+    }
+    return postData
+}
+
+// teeBody captures a body while it is read, and calls done once, when it
+// has been read completely or closed.
+type teeBody struct {
+    io.ReadCloser
+    capture *bodyCapture
+    once    sync.Once
+    done    func()
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    _, _ = b.capture.Write(p[:n])
+    if err != nil {
+        b.finish()
+    }
+    return n, err
+}
+
+func (b *teeBody) Close() error {
+    err := b.ReadCloser.Close()
+    b.finish()
+    return err
+}
+
+// captureBody captures body into capture, holding at most the max bytes of
+// capture and the next one in memory, and returns the body to forward in
+// place of body. done is called once body has been captured: right away
+// when it is not longer than max, or else once the rest of it, forwarded
+// without being held, has been read or closed.
+func captureBody(body io.ReadCloser, capture *bodyCapture, done func()) (io.ReadCloser, error) {
+    var r io.Reader = body
+    if capture.max > 0 {
+        r = io.LimitReader(body, capture.max+1)
+    }
+    head, err := io.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    _, _ = capture.Write(head)
+    if capture.max <= 0 || int64(len(head)) <= capture.max {
+        if done != nil {
+            done()
+        }
+        return readCloser{bytes.NewReader(head), body}, nil
+    }
+    rest := &teeBody{ReadCloser: body, capture: capture, done: done}
+    return readCloser{io.MultiReader(bytes.NewReader(head), rest), rest}, nil
+}
+
+type readCloser struct {
+    io.Reader
+    io.Closer
+}
+
+func (b *teeBody) finish() {
+    b.once.Do(func() {
+        if b.done != nil {
+            b.done()
+        }
+    })
+}
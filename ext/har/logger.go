@@ -2,6 +2,9 @@ package har
 
 import (
     "net/http"
+    "net/http/httptrace"
+    "net/url"
+    "sync"
     "time"
 
     "github.com/elazarl/goproxy"
@@ -15,7 +18,14 @@ type Logger struct {
     exportFunc      ExportFunc
     exportInterval  time.Duration
     exportThreshold int
+    requestBodies   bool
+    maxBodySize     int64
+    streamBodies    bool
     dataCh          chan Entry
+
+    // stopMtx prevents entries completed after Stop from being sent
+    stopMtx sync.RWMutex
+    stopped bool
 }
 
 // LoggerOption is a function type for configuring the Logger
@@ -35,6 +45,38 @@ func WithExportThreshold(threshold int) LoggerOption {
     }
 }
 
+// WithRequestBodies captures the bodies of all the requests, whatever their
+// method and content type. By default, only the bodies of POST and PUT
+// requests with a content type are captured.
+func WithRequestBodies() LoggerOption {
+    return func(l *Logger) {
+        l.requestBodies = true
+    }
+}
+
+// WithMaxBodySize caps the number of bytes of each body captured in the
+// entries. The content of longer bodies is truncated, and its comment tells
+// by how much. Bodies are not capped by default.
+//
+// Only the first size bytes of the bodies are then held in memory, even
+// without WithStreamingBodies: the rest of longer bodies is forwarded as it
+// is read, and their entries are exported once it has been.
+func WithMaxBodySize(size int64) LoggerOption {
+    return func(l *Logger) {
+        l.maxBodySize = size
+    }
+}
+
+// WithStreamingBodies captures the bodies while the proxy forwards them,
+// instead of reading them completely beforehand, so that clients receive
+// the responses without delay. Entries are then exported once the response
+// body has been sent to the client.
+func WithStreamingBodies() LoggerOption {
+    return func(l *Logger) {
+        l.streamBodies = true
+    }
+}
+
 // NewLogger creates a new HAR logger instance
 func NewLogger(exportFunc ExportFunc, opts ...LoggerOption) *Logger {
     l := &Logger{
@@ -52,10 +94,42 @@ func NewLogger(exportFunc ExportFunc, opts ...LoggerOption) *Logger {
     go l.exportLoop()
     return l
 }
-// OnRequest handles incoming HTTP requests
+// pendingEntry is the state of an entry between its request and response.
+type pendingEntry struct {
+    trace   *requestTrace
+    request *Request
+    // reqBody is nil when the request body is not captured
+    reqBody *bodyCapture
+    reqType string
+}
+
+func (l *Logger) capturesRequestBody(req *http.Request) bool {
+    if req.Body == nil || req.Body == http.NoBody {
+        return false
+    }
+    return l.requestBodies ||
+        ((req.Method == http.MethodPost || req.Method == http.MethodPut) && req.Header.Get("Content-Type") != "")
+}
+
+// OnRequest handles incoming HTTP requests, tracing the phases of their
+// round trip to the destination server
 func (l *Logger) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-    ctx.UserData = time.Now()
-    return req, nil
+    trace := newRequestTrace(time.Now())
+    pending := &pendingEntry{trace: trace, request: parseRequest(req)}
+    ctx.UserData = pending
+
+    if l.capturesRequestBody(req) {
+        pending.reqBody = newBodyCapture(l.maxBodySize)
+        pending.reqType = parseMediaType(ctx, req.Header)
+        if l.streamBodies {
+            req.Body = &teeBody{ReadCloser: req.Body, capture: pending.reqBody}
+        } else if body, err := captureBody(req.Body, pending.reqBody, nil); err == nil {
+            req.Body = body
+        } else {
+            ctx.Proxy.Logger.Printf("Error reading body: %v", err)
+        }
+    }
+    return req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace())), nil
 }
 
 // OnResponse handles HTTP responses
@@ -63,28 +137,111 @@ func (l *Logger) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Re
     if resp == nil || ctx.Req == nil || ctx.UserData == nil {
         return resp
     }
-    startTime, ok := ctx.UserData.(time.Time)
+    pending, ok := ctx.UserData.(*pendingEntry)
     if !ok {
         return resp
     }
-    
+
     entry := Entry{
-        StartedDateTime: startTime,
-        Time:           time.Since(startTime).Milliseconds(),
-        Request:        parseRequest(ctx),
-        Response:       parseResponse(ctx),
-        Timings: Timings{
-            Send:    0,
-            Wait:    time.Since(startTime).Milliseconds(),
-            Receive: 0,
-        },
-    }
-    entry.fillIPAddress(ctx.Req)
-    
-    l.dataCh <- entry 
+        StartedDateTime: pending.trace.start,
+        Request:         pending.request,
+        Response:        parseResponse(resp),
+    }
+    capture := newBodyCapture(l.maxBodySize)
+    mediaType := parseMediaType(ctx, resp.Header)
+    // Reading the body completes the receive phase
+    finish := func() {
+        entry.Response.Content = capture.content(mediaType)
+        if pending.reqBody != nil {
+            entry.Request.PostData = pending.reqBody.postData(pending.reqType)
+        }
+        entry.Timings, entry.Time = pending.trace.timings(time.Now())
+        pending.trace.mtx.Lock()
+        entry.ServerIpAddress = pending.trace.serverIP
+        entry.Connection = pending.trace.connection
+        pending.trace.mtx.Unlock()
+        if entry.ServerIpAddress == "" {
+            entry.fillIPAddress(ctx.Req)
+        }
+        l.send(entry)
+    }
+
+    // The body of a protocol switch is the connection itself
+    if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+        finish()
+        return resp
+    }
+    if l.streamBodies {
+        resp.Body = &teeBody{ReadCloser: resp.Body, capture: capture, done: finish}
+        return resp
+    }
+    body, err := captureBody(resp.Body, capture, finish)
+    if err != nil {
+        ctx.Proxy.Logger.Printf("Error reading body: %v", err)
+        finish()
+        return resp
+    }
+    resp.Body = body
     return resp
 }
 
+// HandleConnect implements goproxy.HttpsHandler, adding an entry for each
+// CONNECT tunnel accepted without MITM once it is closed, with its duration
+// and the number of bytes relayed in each direction. Its URL is the https one
+// of the destination host, since HAR has no URL form for tunnels.
+//
+// Register it with proxy.OnRequest().HandleConnect before any HttpsHandler
+// returning an action: the handlers following the one deciding the action
+// of a CONNECT request aren't called for it. A callback already set in
+// ctx.OnTunnelClose by a previous handler is still called.
+func (l *Logger) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+    req := ctx.Req
+    prev := ctx.OnTunnelClose
+    ctx.OnTunnelClose = func(stats goproxy.TunnelStats) {
+        if prev != nil {
+            prev(stats)
+        }
+        duration := stats.End.Sub(stats.Start).Milliseconds()
+        l.send(Entry{
+            StartedDateTime: stats.Start,
+            Time:            duration,
+            Request: &Request{
+                Method:      http.MethodConnect,
+                Url:         (&url.URL{Scheme: "https", Host: stats.Host, Path: "/"}).String(),
+                HttpVersion: req.Proto,
+                Cookies:     []Cookie{},
+                Headers:     parseStringArrMap(req.Header),
+                QueryString: []NameValuePair{},
+                BodySize:    stats.BytesSent,
+                HeadersSize: -1,
+            },
+            Response: &Response{
+                Status:      http.StatusOK,
+                StatusText:  "Connection established",
+                HttpVersion: req.Proto,
+                Cookies:     []Cookie{},
+                Headers:     []NameValuePair{},
+                Content:     Content{Size: int(stats.BytesReceived)},
+                BodySize:    stats.BytesReceived,
+                HeadersSize: -1,
+            },
+            // The tunnel was open for the whole duration
+            Timings: Timings{Blocked: -1, Dns: -1, Connect: -1, Ssl: -1, Receive: duration},
+            Comment: "CONNECT tunnel, content not intercepted",
+        })
+    }
+    return nil, host
+}
+
+// send queues entry for export, unless the logger is stopped.
+func (l *Logger) send(entry Entry) {
+    l.stopMtx.RLock()
+    defer l.stopMtx.RUnlock()
+    if !l.stopped {
+        l.dataCh <- entry
+    }
+}
+
 func (l *Logger) exportLoop() {
    var entries []Entry 
     
@@ -119,6 +276,13 @@ func (l *Logger) exportLoop() {
     }
 }
 
+// Stop exports the remaining entries and stops the logger. Entries
+// completed afterwards are dropped.
 func (l *Logger) Stop() {
-    close(l.dataCh)
+    l.stopMtx.Lock()
+    defer l.stopMtx.Unlock()
+    if !l.stopped {
+        l.stopped = true
+        close(l.dataCh)
+    }
 }
@@ -2,10 +2,13 @@ package har
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -215,3 +218,249 @@ func TestHarLoggerExportInterval(t *testing.T) {
     assert.Equal(t, 3, len(exports[0]), "Should have exported 3 entries")
 }
 
+
+func TestHarLoggerTimings(t *testing.T) {
+    const delay = 50 * time.Millisecond
+
+    var mtx sync.Mutex
+    var exportedEntries []Entry
+    exportFunc := func(entries []Entry) {
+        mtx.Lock()
+        defer mtx.Unlock()
+        exportedEntries = append(exportedEntries, entries...)
+    }
+    logger := NewLogger(exportFunc, WithExportThreshold(1))
+
+    // The server waits before answering, then before sending the body
+    background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(delay)
+        w.WriteHeader(http.StatusOK)
+        w.(http.Flusher).Flush()
+        time.Sleep(delay)
+        io.WriteString(w, "slow")
+    }))
+    defer background.Close()
+    proxyServer := createTestProxy(logger)
+    defer proxyServer.Close()
+    client := createProxyClient(proxyServer.URL)
+
+    // The second request reuses the connection of the first one
+    for i := 0; i < 2; i++ {
+        req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, background.URL, nil)
+        require.NoError(t, err)
+        resp, err := client.Do(req)
+        require.NoError(t, err)
+        _, err = io.ReadAll(resp.Body)
+        require.NoError(t, err)
+        resp.Body.Close()
+    }
+
+    require.Eventually(t, func() bool {
+        mtx.Lock()
+        defer mtx.Unlock()
+        return len(exportedEntries) == 2
+    }, time.Second, 10*time.Millisecond)
+    logger.Stop()
+
+    // Exports happen concurrently, in any order
+    sort.Slice(exportedEntries, func(i, j int) bool {
+        return exportedEntries[i].StartedDateTime.Before(exportedEntries[j].StartedDateTime)
+    })
+    first, second := exportedEntries[0], exportedEntries[1]
+    for _, entry := range exportedEntries {
+        assert.GreaterOrEqual(t, entry.Timings.Wait, delay.Milliseconds(), "wait should cover the server think time")
+        assert.GreaterOrEqual(t, entry.Timings.Receive, delay.Milliseconds(), "receive should cover the body transfer")
+        assert.Equal(t, int64(-1), entry.Timings.Ssl, "ssl should not apply to plain HTTP")
+        assert.Equal(t, "127.0.0.1", entry.ServerIpAddress)
+        assert.NotEmpty(t, entry.Connection)
+
+        sum := entry.Timings.Blocked + max(entry.Timings.Dns, 0) + max(entry.Timings.Connect, 0) +
+            entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+        assert.Equal(t, entry.Time, sum, "time should be the sum of the timings")
+    }
+    assert.GreaterOrEqual(t, first.Timings.Connect, int64(0), "first request should open a connection")
+    assert.Equal(t, int64(-1), second.Timings.Connect, "second request should reuse the connection")
+    assert.Equal(t, int64(-1), second.Timings.Dns)
+    assert.Equal(t, first.Connection, second.Connection)
+}
+
+// exportOne sends req through a proxy logging with opts, and returns the
+// response body and the logged entry.
+func exportOne(t *testing.T, handler http.Handler, req *http.Request, opts ...LoggerOption) (string, Entry) {
+    t.Helper()
+    entries := make(chan Entry, 1)
+    exportFunc := func(exported []Entry) {
+        entries <- exported[0]
+    }
+    logger := NewLogger(exportFunc, append([]LoggerOption{WithExportThreshold(1)}, opts...)...)
+    defer logger.Stop()
+
+    background := httptest.NewServer(handler)
+    defer background.Close()
+    proxyServer := createTestProxy(logger)
+    defer proxyServer.Close()
+
+    req.URL, _ = url.Parse(background.URL + req.URL.String())
+    resp, err := createProxyClient(proxyServer.URL).Do(req)
+    require.NoError(t, err)
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+
+    select {
+    case entry := <-entries:
+        return string(body), entry
+    case <-time.After(time.Second):
+        t.Fatal("No entry exported")
+        return "", Entry{}
+    }
+}
+
+func TestHarLoggerBinaryContent(t *testing.T) {
+    binary := []byte{0x89, 'P', 'N', 'G', 0, 0xff, 0xfe}
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "image/png")
+        w.Write(binary)
+    })
+    req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/logo.png", nil)
+    require.NoError(t, err)
+
+    body, entry := exportOne(t, handler, req)
+    assert.Equal(t, string(binary), body)
+    assert.Equal(t, "base64", entry.Response.Content.Encoding)
+    assert.Equal(t, base64.StdEncoding.EncodeToString(binary), entry.Response.Content.Text)
+    assert.Equal(t, len(binary), entry.Response.Content.Size)
+    assert.Equal(t, "image/png", entry.Response.Content.MimeType)
+}
+
+func TestHarLoggerMaxBodySize(t *testing.T) {
+    var received string
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b, _ := io.ReadAll(r.Body)
+        received = string(b)
+        io.WriteString(w, "héllo world")
+    })
+    req, err := http.NewRequestWithContext(context.Background(), http.MethodPatch, "/", strings.NewReader("0123456789"))
+    require.NoError(t, err)
+
+    // The cap cuts the "é" in half, which must not turn the text into binary
+    body, entry := exportOne(t, handler, req, WithRequestBodies(), WithMaxBodySize(2))
+    assert.Equal(t, "héllo world", body, "client should receive the whole response")
+    assert.Equal(t, "0123456789", received, "server should receive the whole request")
+
+    assert.Equal(t, "h", entry.Response.Content.Text)
+    assert.Empty(t, entry.Response.Content.Encoding)
+    assert.Equal(t, len("héllo world"), entry.Response.Content.Size)
+    assert.Equal(t, "truncated to 2 of 12 bytes", entry.Response.Content.Comment)
+
+    require.NotNil(t, entry.Request.PostData, "request bodies of any method should be captured")
+    assert.Equal(t, "01", entry.Request.PostData.Text)
+    assert.Equal(t, "truncated to 2 of 10 bytes", entry.Request.PostData.Comment)
+}
+
+func TestHarLoggerMaxBodySizeForwardsRest(t *testing.T) {
+    // The origin only ends the body once the client got the response, which
+    // it can't if the proxy reads the whole body before forwarding it. The
+    // beginning of the body is larger than the buffer of the proxy's writer.
+    head := strings.Repeat("x", 8<<10)
+    received := make(chan struct{})
+    var waited bool
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.WriteString(w, head)
+        w.(http.Flusher).Flush()
+        select {
+        case <-received:
+            io.WriteString(w, "end")
+        case <-time.After(time.Second):
+            waited = true
+        }
+    })
+    entries := make(chan Entry, 1)
+    logger := NewLogger(func(exported []Entry) {
+        entries <- exported[0]
+    }, WithExportThreshold(1), WithMaxBodySize(2))
+    defer logger.Stop()
+
+    background := httptest.NewServer(handler)
+    defer background.Close()
+    proxyServer := createTestProxy(logger)
+    defer proxyServer.Close()
+
+    resp, err := createProxyClient(proxyServer.URL).Get(background.URL)
+    require.NoError(t, err)
+    defer resp.Body.Close()
+    close(received)
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    assert.False(t, waited, "proxy should forward the response before the end of its body")
+    assert.Equal(t, head+"end", string(body))
+
+    select {
+    case entry := <-entries:
+        assert.Equal(t, "xx", entry.Response.Content.Text)
+        assert.Equal(t, fmt.Sprintf("truncated to 2 of %d bytes", len(head)+3), entry.Response.Content.Comment)
+    case <-time.After(time.Second):
+        t.Fatal("No entry exported")
+    }
+}
+
+func TestHarLoggerFormParams(t *testing.T) {
+    handler := ConstantHandler("ok")
+    req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "/", strings.NewReader("a=1&b=2"))
+    require.NoError(t, err)
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    _, entry := exportOne(t, handler, req)
+    require.NotNil(t, entry.Request.PostData)
+    assert.ElementsMatch(t, []PostDataParam{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, entry.Request.PostData.Params)
+}
+
+func TestHarLoggerStreamingBodies(t *testing.T) {
+    release := make(chan struct{})
+    // Server-sent events are flushed to the client as they arrive
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/event-stream")
+        io.WriteString(w, "first ")
+        w.(http.Flusher).Flush()
+        <-release
+        io.WriteString(w, "second")
+    })
+
+    entries := make(chan Entry, 1)
+    logger := NewLogger(func(exported []Entry) {
+        entries <- exported[0]
+    }, WithExportThreshold(1), WithStreamingBodies())
+    defer logger.Stop()
+    background := httptest.NewServer(handler)
+    defer background.Close()
+    proxyServer := createTestProxy(logger)
+    defer proxyServer.Close()
+
+    resp, err := createProxyClient(proxyServer.URL).Get(background.URL)
+    require.NoError(t, err)
+    defer resp.Body.Close()
+
+    // The beginning of the body reaches the client before the server ends it
+    first := make([]byte, len("first "))
+    _, err = io.ReadFull(resp.Body, first)
+    require.NoError(t, err)
+    assert.Equal(t, "first ", string(first))
+    select {
+    case <-entries:
+        t.Fatal("Entry exported before the end of the body")
+    default:
+    }
+
+    close(release)
+    rest, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "second", string(rest))
+
+    select {
+    case entry := <-entries:
+        assert.Equal(t, "first second", entry.Response.Content.Text)
+        assert.Equal(t, len("first second"), entry.Response.Content.Size)
+    case <-time.After(time.Second):
+        t.Fatal("No entry exported")
+    }
+}
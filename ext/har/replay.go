@@ -0,0 +1,211 @@
+package har
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "slices"
+    "sync"
+
+    "github.com/elazarl/goproxy"
+    "github.com/elazarl/goproxy/ext/internal/replay"
+    "github.com/elazarl/goproxy/ext/internal/urlutil"
+)
+
+// LoadFile reads a HAR document from the file at path
+func LoadFile(path string) (*Har, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var har Har
+    if err := json.Unmarshal(data, &har); err != nil {
+        return nil, fmt.Errorf("invalid HAR document in %s: %w", path, err)
+    }
+    return &har, nil
+}
+
+// Replayer answers requests with the responses recorded in a HAR document,
+// for example to reproduce a session captured by a browser.
+//
+//	doc, err := har.LoadFile("session.har")
+//	...
+//	replayer := har.NewReplayer(doc)
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest().DoFunc(replayer.OnRequest)
+//
+// Requests are matched with the entries by method and URL, and optionally
+// by body. Identical requests are answered in the recorded order, the last
+// matching entry answering them once all have been replayed.
+type Replayer struct {
+    entries         []Entry
+    matchBody       bool
+    passthrough     bool
+    unmatchedStatus int
+
+    mtx      sync.Mutex
+    replayed []bool
+    misses   replay.Misses
+}
+
+// ReplayerOption is a function type for configuring the Replayer
+type ReplayerOption func(*Replayer)
+
+// WithBodyMatching also matches requests with the entries by body
+func WithBodyMatching() ReplayerOption {
+    return func(r *Replayer) {
+        r.matchBody = true
+    }
+}
+
+// WithPassthrough forwards the requests that don't match any entry,
+// instead of failing them
+func WithPassthrough() ReplayerOption {
+    return func(r *Replayer) {
+        r.passthrough = true
+    }
+}
+
+// WithUnmatchedStatus sets the status of the responses to the requests
+// that don't match any entry, 502 Bad Gateway by default
+func WithUnmatchedStatus(status int) ReplayerOption {
+    return func(r *Replayer) {
+        r.unmatchedStatus = status
+    }
+}
+
+// NewReplayer creates a Replayer answering with the entries of har
+func NewReplayer(har *Har, opts ...ReplayerOption) *Replayer {
+    r := &Replayer{
+        entries:         har.Log.Entries,
+        unmatchedStatus: http.StatusBadGateway,
+        replayed:        make([]bool, len(har.Log.Entries)),
+    }
+    for _, opt := range opts {
+        opt(r)
+    }
+    return r
+}
+
+// Misses returns the requests that didn't match any entry, as "METHOD URL"
+// strings
+func (r *Replayer) Misses() []string {
+    return r.misses.List()
+}
+
+func decodeText(text, encoding string) []byte {
+    if encoding == "base64" {
+        if data, err := base64.StdEncoding.DecodeString(text); err == nil {
+            return data
+        }
+    }
+    return []byte(text)
+}
+
+// matchPostData reports whether body is the one recorded in postData
+func matchPostData(body []byte, postData *PostData) bool {
+    if postData == nil {
+        return len(body) == 0
+    }
+    if len(postData.Params) == 0 {
+        return bytes.Equal(body, decodeText(postData.Text, postData.Encoding))
+    }
+    values, err := url.ParseQuery(string(body))
+    if err != nil {
+        return false
+    }
+    var got, recorded []string
+    for name, vals := range values {
+        for _, v := range vals {
+            got = append(got, name+"="+v)
+        }
+    }
+    for _, param := range postData.Params {
+        recorded = append(recorded, param.Name+"="+param.Value)
+    }
+    slices.Sort(got)
+    slices.Sort(recorded)
+    return slices.Equal(got, recorded)
+}
+
+func (r *Replayer) match(req *http.Request, body []byte, entry *Entry) bool {
+    if entry.Request == nil || entry.Response == nil || entry.Request.Method != req.Method {
+        return false
+    }
+    recorded, err := url.Parse(entry.Request.Url)
+    if err != nil || urlutil.Normalize(recorded) != urlutil.Normalize(req.URL) {
+        return false
+    }
+    return !r.matchBody || matchPostData(body, entry.Request.PostData)
+}
+
+// find returns the first matching entry that hasn't been replayed yet, or
+// the last matching entry once they all have been
+func (r *Replayer) find(req *http.Request, body []byte) *Entry {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    n := replay.Pick(r.replayed, func(n int) bool {
+        return r.match(req, body, &r.entries[n])
+    })
+    if n < 0 {
+        return nil
+    }
+    return &r.entries[n]
+}
+
+// OnRequest answers req with the response of the entry it matches
+func (r *Replayer) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+    var body []byte
+    if r.matchBody {
+        var err error
+        if body, err = replay.ReadBody(req); err != nil {
+            ctx.Warnf("har: cannot read body of %v %v: %v", req.Method, req.URL, err)
+            return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+        }
+    }
+
+    entry := r.find(req, body)
+    if entry == nil {
+        return r.misses.Handle(req, ctx, "har: no entry matches", r.passthrough, r.unmatchedStatus)
+    }
+    ctx.Logf("har: replaying %v %v", req.Method, req.URL)
+    return req, replayResponse(req, entry.Response)
+}
+
+func replayResponse(req *http.Request, recorded *Response) *http.Response {
+    content := decodeText(recorded.Content.Text, recorded.Content.Encoding)
+    header := make(http.Header)
+    for _, h := range recorded.Headers {
+        header.Add(h.Name, h.Value)
+    }
+    // The recorded content is decoded, and its length is the one of the
+    // replayed body
+    for _, name := range []string{"Content-Encoding", "Content-Length", "Transfer-Encoding"} {
+        header.Del(name)
+    }
+    if header.Get("Content-Type") == "" && recorded.Content.MimeType != "" {
+        header.Set("Content-Type", recorded.Content.MimeType)
+    }
+
+    status := recorded.Status
+    statusText := recorded.StatusText
+    if statusText == "" {
+        statusText = http.StatusText(status)
+    }
+    return &http.Response{
+        Status:        fmt.Sprintf("%d %s", status, statusText),
+        StatusCode:    status,
+        Proto:         "HTTP/1.1",
+        ProtoMajor:    1,
+        ProtoMinor:    1,
+        Header:        header,
+        Body:          io.NopCloser(bytes.NewReader(content)),
+        ContentLength: int64(len(content)),
+        Request:       req,
+    }
+}
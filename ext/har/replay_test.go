@@ -0,0 +1,110 @@
+package har
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const replayHar = `{"log": {"version": "1.2", "creator": {"name": "browser", "version": "1"}, "entries": [
+  {"startedDateTime": "2026-01-02T03:04:05Z", "time": 10,
+   "request": {"method": "GET", "url": "https://api.example/items", "httpVersion": "HTTP/2", "headers": [], "queryString": [], "cookies": [], "bodySize": 0, "headersSize": -1},
+   "response": {"status": 200, "statusText": "OK", "httpVersion": "HTTP/2", "cookies": [], "redirectURL": "", "bodySize": 3, "headersSize": -1,
+     "headers": [{"name": "Content-Type", "value": "application/json"}, {"name": "Content-Encoding", "value": "gzip"}, {"name": "X-Id", "value": "first"}],
+     "content": {"size": 2, "mimeType": "application/json", "text": "[]"}},
+   "cache": {}, "timings": {"send": 0, "wait": 10, "receive": 0}},
+  {"startedDateTime": "2026-01-02T03:04:06Z", "time": 10,
+   "request": {"method": "GET", "url": "https://api.example/items", "httpVersion": "HTTP/2", "headers": [], "queryString": [], "cookies": [], "bodySize": 0, "headersSize": -1},
+   "response": {"status": 200, "statusText": "OK", "httpVersion": "HTTP/2", "cookies": [], "redirectURL": "", "bodySize": 3, "headersSize": -1,
+     "headers": [{"name": "X-Id", "value": "second"}],
+     "content": {"size": 4, "mimeType": "application/json", "text": "[1]"}},
+   "cache": {}, "timings": {"send": 0, "wait": 10, "receive": 0}},
+  {"startedDateTime": "2026-01-02T03:04:07Z", "time": 10,
+   "request": {"method": "GET", "url": "https://api.example/logo.png", "httpVersion": "HTTP/2", "headers": [], "queryString": [], "cookies": [], "bodySize": 0, "headersSize": -1},
+   "response": {"status": 200, "statusText": "OK", "httpVersion": "HTTP/2", "cookies": [], "redirectURL": "", "bodySize": 4, "headersSize": -1, "headers": [],
+     "content": {"size": 4, "mimeType": "image/png", "text": "iVBORw==", "encoding": "base64"}},
+   "cache": {}, "timings": {"send": 0, "wait": 10, "receive": 0}},
+  {"startedDateTime": "2026-01-02T03:04:08Z", "time": 10,
+   "request": {"method": "POST", "url": "https://api.example/login", "httpVersion": "HTTP/2", "headers": [], "queryString": [], "cookies": [], "bodySize": 7, "headersSize": -1,
+     "postData": {"mimeType": "application/x-www-form-urlencoded", "params": [{"name": "user", "value": "bob"}]}},
+   "response": {"status": 204, "statusText": "No Content", "httpVersion": "HTTP/2", "cookies": [], "redirectURL": "", "bodySize": 0, "headersSize": -1, "headers": [],
+     "content": {"size": 0, "mimeType": ""}},
+   "cache": {}, "timings": {"send": 0, "wait": 10, "receive": 0}}
+]}}`
+
+func newReplayClient(t *testing.T, opts ...ReplayerOption) (*Replayer, *http.Client) {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "session.har")
+    require.NoError(t, os.WriteFile(path, []byte(replayHar), 0o600))
+    doc, err := LoadFile(path)
+    require.NoError(t, err)
+    replayer := NewReplayer(doc, opts...)
+
+    proxy := goproxy.NewProxyHttpServer()
+    proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+    proxy.OnRequest().DoFunc(replayer.OnRequest)
+    return replayer, proxytest.NewClient(t, proxy)
+}
+
+func TestReplayerAnswersInOrder(t *testing.T) {
+    _, client := newReplayClient(t)
+
+    resp, body := proxytest.Do(t, client, http.MethodGet, "https://api.example/items", "", nil)
+    assert.Equal(t, "[]", body)
+    assert.Equal(t, "first", resp.Header.Get("X-Id"))
+    assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+    assert.Empty(t, resp.Header.Get("Content-Encoding"), "content is recorded decoded")
+
+    // Then the second one, which keeps answering once all are replayed
+    for i := 0; i < 2; i++ {
+        resp, body = proxytest.Do(t, client, http.MethodGet, "https://api.example/items#top", "", nil)
+        assert.Equal(t, "[1]", body)
+        assert.Equal(t, "second", resp.Header.Get("X-Id"))
+    }
+}
+
+func TestReplayerBase64Content(t *testing.T) {
+    _, client := newReplayClient(t)
+    resp, body := proxytest.Do(t, client, http.MethodGet, "https://api.example/logo.png", "", nil)
+    expected, _ := base64.StdEncoding.DecodeString("iVBORw==")
+    assert.Equal(t, string(expected), body)
+    assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+}
+
+func TestReplayerBodyMatching(t *testing.T) {
+    replayer, client := newReplayClient(t, WithBodyMatching(), WithUnmatchedStatus(http.StatusNotFound))
+
+    resp, err := client.Post("https://api.example/login", "application/x-www-form-urlencoded", strings.NewReader("user=bob"))
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+    resp, err = client.Post("https://api.example/login", "application/x-www-form-urlencoded", strings.NewReader("user=eve"))
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+    assert.Equal(t, []string{"POST https://api.example:443/login"}, replayer.Misses())
+}
+
+func TestReplayerPassthrough(t *testing.T) {
+    background := httptest.NewServer(ConstantHandler("live"))
+    defer background.Close()
+
+    _, client := newReplayClient(t)
+    resp, _ := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+    assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+    replayer, client := newReplayClient(t, WithPassthrough())
+    _, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", nil)
+    assert.Equal(t, "live", body)
+    assert.Equal(t, []string{"GET " + background.URL + "/"}, replayer.Misses())
+}
@@ -0,0 +1,156 @@
+package har
+
+import (
+    "crypto/tls"
+    "net"
+    "net/http/httptrace"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// requestTrace records when the phases of a proxied request happen, using
+// the httptrace hooks of the transport sending it to the destination server.
+type requestTrace struct {
+    mtx sync.Mutex
+
+    start        time.Time
+    getConn      time.Time
+    dnsStart     time.Time
+    dnsDone      time.Time
+    connectStart time.Time
+    connectDone  time.Time
+    tlsStart     time.Time
+    tlsDone      time.Time
+    gotConn      time.Time
+    wroteRequest time.Time
+    firstByte    time.Time
+
+    reused     bool
+    serverIP   string
+    connection string
+}
+
+func newRequestTrace(start time.Time) *requestTrace {
+    return &requestTrace{start: start}
+}
+
+func (t *requestTrace) record(field *time.Time) {
+    t.mtx.Lock()
+    defer t.mtx.Unlock()
+    // Keep the first occurrence: the transport may dial several addresses
+    // of the same host, and we only need the span of the whole phase.
+    if field.IsZero() {
+        *field = time.Now()
+    }
+}
+
+func (t *requestTrace) recordDone(field *time.Time) {
+    t.mtx.Lock()
+    defer t.mtx.Unlock()
+    *field = time.Now()
+}
+
+// clientTrace returns the hooks filling t.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+    return &httptrace.ClientTrace{
+        GetConn: func(string) {
+            t.record(&t.getConn)
+        },
+        DNSStart: func(httptrace.DNSStartInfo) {
+            t.record(&t.dnsStart)
+        },
+        DNSDone: func(httptrace.DNSDoneInfo) {
+            t.recordDone(&t.dnsDone)
+        },
+        ConnectStart: func(string, string) {
+            t.record(&t.connectStart)
+        },
+        ConnectDone: func(string, string, error) {
+            t.recordDone(&t.connectDone)
+        },
+        TLSHandshakeStart: func() {
+            t.record(&t.tlsStart)
+        },
+        TLSHandshakeDone: func(tls.ConnectionState, error) {
+            t.recordDone(&t.tlsDone)
+        },
+        GotConn: func(info httptrace.GotConnInfo) {
+            t.mtx.Lock()
+            defer t.mtx.Unlock()
+            t.gotConn = time.Now()
+            t.reused = info.Reused
+            if info.Conn == nil {
+                return
+            }
+            if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+                t.serverIP = addr.IP.String()
+            }
+            // HAR identifies connections by the client port number
+            if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+                t.connection = strconv.Itoa(addr.Port)
+            }
+        },
+        WroteRequest: func(httptrace.WroteRequestInfo) {
+            t.recordDone(&t.wroteRequest)
+        },
+        GotFirstResponseByte: func() {
+            t.record(&t.firstByte)
+        },
+    }
+}
+
+func span(from, to time.Time) int64 {
+    if from.IsZero() || to.IsZero() || to.Before(from) {
+        return -1
+    }
+    return to.Sub(from).Milliseconds()
+}
+
+// timings returns the HAR timings of the request, received completely at end,
+// and its total time. Phases that didn't happen, like DNS resolution and
+// connection on a reused connection, are -1 as required by HAR.
+func (t *requestTrace) timings(end time.Time) (Timings, int64) {
+    t.mtx.Lock()
+    defer t.mtx.Unlock()
+
+    if t.gotConn.IsZero() || t.firstByte.IsZero() {
+        // The request was not sent to the destination server, for example
+        // because a handler answered it.
+        wait := end.Sub(t.start).Milliseconds()
+        return Timings{Blocked: -1, Dns: -1, Connect: -1, Ssl: -1, Wait: wait}, wait
+    }
+
+    timings := Timings{
+        Dns:     -1,
+        Connect: -1,
+        Ssl:     -1,
+    }
+    if !t.reused {
+        timings.Dns = span(t.dnsStart, t.dnsDone)
+        // HAR includes the TLS handshake in the connect phase
+        connectDone := t.connectDone
+        if t.tlsDone.After(connectDone) {
+            connectDone = t.tlsDone
+        }
+        timings.Connect = span(t.connectStart, connectDone)
+        timings.Ssl = span(t.tlsStart, t.tlsDone)
+    }
+    timings.Blocked = t.gotConn.Sub(t.start).Milliseconds() - max(timings.Dns, 0) - max(timings.Connect, 0)
+    if timings.Blocked < 0 {
+        timings.Blocked = 0
+    }
+
+    wroteRequest := t.wroteRequest
+    if wroteRequest.IsZero() || wroteRequest.After(t.firstByte) {
+        // The server may answer before reading the whole request
+        wroteRequest = t.firstByte
+    }
+    timings.Send = max(span(t.gotConn, wroteRequest), 0)
+    timings.Wait = max(span(wroteRequest, t.firstByte), 0)
+    timings.Receive = max(span(t.firstByte, end), 0)
+
+    total := timings.Blocked + max(timings.Dns, 0) + max(timings.Connect, 0) +
+        timings.Send + timings.Wait + timings.Receive
+    return timings, total
+}
@@ -3,8 +3,6 @@
 package har
 
 import (
-    "bytes"
-    "io"
     "net/http"
     "net/url"
     "mime"
@@ -116,16 +114,6 @@ func (entry *Entry) fillIPAddress(req *http.Request) {
     } 
 }
 
-// Shared utility function for reading body content
-func readBody(ctx *goproxy.ProxyCtx, body io.ReadCloser) ([]byte, error) {
-    content, err := io.ReadAll(body)
-    if err != nil {
-        ctx.Proxy.Logger.Printf("Error reading body: %v", err)
-        return nil, err
-    }
-    return content, nil
-}
-
 // Shared function for handling mime types
 func parseMediaType(ctx *goproxy.ProxyCtx, header http.Header) string {
     contentType := header.Get("Content-Type")
@@ -141,39 +129,6 @@ func parseMediaType(ctx *goproxy.ProxyCtx, header http.Header) string {
     return mediaType
 }
 
-func parsePostData(ctx *goproxy.ProxyCtx, req *http.Request) *PostData {
-    mediaType := parseMediaType(ctx, req.Header)
-    if mediaType == "" {
-        return nil
-    }
-    
-    harPostData := &PostData{
-        MimeType: mediaType,
-    } 
-
-    if err := req.ParseForm(); err != nil {
-        ctx.Proxy.Logger.Printf("Error parsing form: %v", err)
-        return nil
-    }
-    
-    if len(req.PostForm) > 0 {
-        for k, vals := range req.PostForm {
-            for _, v := range vals {
-                param := PostDataParam{
-                    Name:  k,
-                    Value: v,
-                }
-                harPostData.Params = append(harPostData.Params, param)
-            }
-        }
-    } else if body, err := readBody(ctx, req.Body); err == nil {
-        req.Body = io.NopCloser(bytes.NewBuffer(body))
-        harPostData.Text = string(body)
-    }
-    
-    return harPostData
-}
-
 type Response struct {
 	Status      int             `json:"status"`
 	StatusText  string          `json:"statusText"`
@@ -187,13 +142,9 @@ type Response struct {
 	Comment     string          `json:"comment,omitempty"`
 }
 
-func parseResponse(ctx *goproxy.ProxyCtx) *Response {
-    if ctx.Resp == nil {
-        return nil
-    } 
-
-    resp := ctx.Resp
-    harResponse := Response{
+// parseResponse returns the HAR response of resp, without its content
+func parseResponse(resp *http.Response) *Response {
+    return &Response{
         Status:      resp.StatusCode,
         StatusText:  http.StatusText(resp.StatusCode),
         HttpVersion: resp.Proto,
@@ -203,34 +154,11 @@ func parseResponse(ctx *goproxy.ProxyCtx) *Response {
         BodySize:    resp.ContentLength,
         HeadersSize: -1,
     }
-
-    if resp.Body == nil {
-        return &harResponse
-    }
-
-    body, err := readBody(ctx, resp.Body)
-    if err != nil {
-        return &harResponse
-    }
-
-    resp.Body = io.NopCloser(bytes.NewBuffer(body))
-    harResponse.Content = Content{
-        Size:     len(body),
-        Text:     string(body),
-        MimeType: parseMediaType(ctx, resp.Header),
-    }
-
-    return &harResponse
 }
 
-func parseRequest(ctx *goproxy.ProxyCtx) *Request {
-    if ctx.Req == nil {
-        ctx.Proxy.Logger.Printf("ParseRequest: nil request")
-        return nil
-    }
-    
-    req := ctx.Req
-    harRequest := &Request{
+// parseRequest returns the HAR request of req, without its post data
+func parseRequest(req *http.Request) *Request {
+    return &Request{
         Method:      req.Method,
         Url:         req.URL.String(),
         HttpVersion: req.Proto,
@@ -240,19 +168,6 @@ func parseRequest(ctx *goproxy.ProxyCtx) *Request {
         BodySize:    req.ContentLength,
         HeadersSize: -1,
     }
-    
-    if req.Method != http.MethodPost && req.Method != http.MethodPut {
-        return harRequest
-    }
-
-    ctx.Proxy.Logger.Printf("ParseRequest: creating PostData, hasBody=%v, hasGetBody=%v", 
-        req.Body != nil, req.GetBody != nil)
-        
-    if postData := parsePostData(ctx, req); postData != nil {
-        harRequest.PostData = postData
-    }
-
-    return harRequest
 }
 
 func parseStringArrMap(stringArrMap map[string][]string) []NameValuePair {
@@ -320,7 +235,10 @@ type PostData struct {
 	MimeType string          `json:"mimeType"`
 	Params   []PostDataParam `json:"params,omitempty"`
 	Text     string          `json:"text,omitempty"`
-	Comment  string          `json:"comment,omitempty"`
+	// Encoding is "base64" when Text is base64 encoded binary data. HAR
+	// does not define it for post data, hence the custom field name.
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
 }
 
 type PostDataParam struct {
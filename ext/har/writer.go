@@ -0,0 +1,237 @@
+package har
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Format is the layout of the files written by a FileWriter.
+type Format int
+
+const (
+    // FormatHAR writes a HAR 1.2 document per file. The document stays
+    // valid after each export, so it can be opened while being written.
+    FormatHAR Format = iota
+    // FormatJSONL writes a HAR document per line, holding the entries of
+    // one export.
+    FormatJSONL
+)
+
+const harFooter = "\n]}}\n"
+
+// FileWriter writes the entries exported by a Logger to a file, rotating it
+// when it gets too big or too old. Rotated files are renamed with the time
+// of their rotation, "proxy.har" becoming "proxy-20060102T150405.000.har".
+//
+//	w, err := har.NewFileWriter("proxy.har", har.WithMaxFileSize(100<<20))
+//	...
+//	logger := har.NewLogger(w.Export)
+type FileWriter struct {
+    path    string
+    format  Format
+    maxSize int64
+    maxAge  time.Duration
+
+    mtx     sync.Mutex
+    file    *os.File
+    size    int64
+    opened  time.Time
+    entries int
+}
+
+// FileWriterOption is a function type for configuring the FileWriter
+type FileWriterOption func(*FileWriter)
+
+// WithFormat sets the layout of the files, FormatHAR by default
+func WithFormat(format Format) FileWriterOption {
+    return func(w *FileWriter) {
+        w.format = format
+    }
+}
+
+// WithMaxFileSize rotates the file once it reaches size bytes
+func WithMaxFileSize(size int64) FileWriterOption {
+    return func(w *FileWriter) {
+        w.maxSize = size
+    }
+}
+
+// WithMaxFileAge rotates the file when entries are written to it more
+// than d after its creation
+func WithMaxFileAge(d time.Duration) FileWriterOption {
+    return func(w *FileWriter) {
+        w.maxAge = d
+    }
+}
+
+// NewFileWriter creates a FileWriter writing to the file at path. An
+// existing HAR file is rotated first, while JSONL files are appended to.
+func NewFileWriter(path string, opts ...FileWriterOption) (*FileWriter, error) {
+    w := &FileWriter{path: path}
+    for _, opt := range opts {
+        opt(w)
+    }
+
+    if w.format == FormatJSONL {
+        file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+        if err != nil {
+            return nil, err
+        }
+        fi, err := file.Stat()
+        if err != nil {
+            _ = file.Close()
+            return nil, err
+        }
+        w.file, w.size, w.opened = file, fi.Size(), time.Now()
+        return w, nil
+    }
+
+    if fi, err := os.Stat(path); err == nil {
+        if err := os.Rename(path, rotatedPath(path, fi.ModTime())); err != nil {
+            return nil, err
+        }
+    }
+    if err := w.open(); err != nil {
+        return nil, err
+    }
+    return w, nil
+}
+
+func rotatedPath(path string, t time.Time) string {
+    ext := filepath.Ext(path)
+    return strings.TrimSuffix(path, ext) + "-" + t.Format("20060102T150405.000") + ext
+}
+
+// open creates the file, with an empty HAR document for FormatHAR
+func (w *FileWriter) open() error {
+    file, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+    if err != nil {
+        return err
+    }
+    w.file, w.size, w.opened, w.entries = file, 0, time.Now(), 0
+    if w.format != FormatHAR {
+        return nil
+    }
+
+    creator, err := json.Marshal(New().Log.Creator)
+    if err != nil {
+        return err
+    }
+    header := `{"log":{"version":"1.2","creator":` + string(creator) + `,"entries":[` + harFooter
+    n, err := io.WriteString(file, header)
+    w.size = int64(n)
+    return err
+}
+
+// rotate renames the file and opens a new one. The renamed file stays open
+// until the new one is, so that entries keep being written to it when the
+// rotation fails.
+func (w *FileWriter) rotate() error {
+    if err := os.Rename(w.path, rotatedPath(w.path, time.Now())); err != nil {
+        return err
+    }
+    file, size, opened, entries := w.file, w.size, w.opened, w.entries
+    if err := w.open(); err != nil {
+        if w.file != file {
+            _ = w.file.Close()
+        }
+        w.file, w.size, w.opened, w.entries = file, size, opened, entries
+        return err
+    }
+    return file.Close()
+}
+
+func (w *FileWriter) needsRotation() bool {
+    if w.size == 0 || (w.format == FormatHAR && w.entries == 0) {
+        return false
+    }
+    return (w.maxSize > 0 && w.size >= w.maxSize) ||
+        (w.maxAge > 0 && time.Since(w.opened) >= w.maxAge)
+}
+
+// Write writes entries to the file. When the file can't be rotated, the
+// entries are written to the current one and the rotation error is returned.
+// The rotation is tried again on the next write.
+func (w *FileWriter) Write(entries []Entry) error {
+    if len(entries) == 0 {
+        return nil
+    }
+    w.mtx.Lock()
+    defer w.mtx.Unlock()
+    if w.file == nil {
+        return os.ErrClosed
+    }
+    var rotateErr error
+    if w.needsRotation() {
+        if err := w.rotate(); err != nil {
+            rotateErr = fmt.Errorf("cannot rotate: %w", err)
+        }
+    }
+
+    var buf bytes.Buffer
+    if w.format == FormatJSONL {
+        har := New()
+        har.Log.Entries = entries
+        if err := json.NewEncoder(&buf).Encode(har); err != nil {
+            return err
+        }
+        n, err := w.file.Write(buf.Bytes())
+        w.size += int64(n)
+        if err != nil {
+            return err
+        }
+        return rotateErr
+    }
+
+    for i, entry := range entries {
+        data, err := json.Marshal(entry)
+        if err != nil {
+            return err
+        }
+        if w.entries+i > 0 {
+            buf.WriteString(",")
+        }
+        buf.WriteString("\n")
+        buf.Write(data)
+    }
+    buf.WriteString(harFooter)
+
+    // Overwrite the footer closing the document with the new entries,
+    // followed by the footer again
+    offset := w.size - int64(len(harFooter))
+    n, err := w.file.WriteAt(buf.Bytes(), offset)
+    w.size = offset + int64(n)
+    if err != nil {
+        return err
+    }
+    w.entries += len(entries)
+    return rotateErr
+}
+
+// Export writes entries to the file, logging errors. It is meant to be
+// passed to NewLogger.
+func (w *FileWriter) Export(entries []Entry) {
+    if err := w.Write(entries); err != nil {
+        log.Printf("har: writing %d entries to %s: %v", len(entries), w.path, err)
+    }
+}
+
+// Close closes the file. Entries can't be written afterwards.
+func (w *FileWriter) Close() error {
+    w.mtx.Lock()
+    defer w.mtx.Unlock()
+    if w.file == nil {
+        return os.ErrClosed
+    }
+    err := w.file.Close()
+    w.file = nil
+    return err
+}
@@ -0,0 +1,189 @@
+package har
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntry(url string) Entry {
+    return Entry{
+        StartedDateTime: time.Now(),
+        Request:         &Request{Method: http.MethodGet, Url: url},
+        Response:        &Response{Status: http.StatusOK},
+    }
+}
+
+func readHar(t *testing.T, path string) *Har {
+    t.Helper()
+    data, err := os.ReadFile(path)
+    require.NoError(t, err)
+    var har Har
+    require.NoError(t, json.Unmarshal(data, &har), "file should be a valid HAR document")
+    return &har
+}
+
+func TestFileWriterHAR(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "proxy.har")
+    w, err := NewFileWriter(path)
+    require.NoError(t, err)
+
+    // The document is valid before and after each write
+    assert.Empty(t, readHar(t, path).Log.Entries)
+    require.NoError(t, w.Write([]Entry{testEntry("http://a/")}))
+    assert.Len(t, readHar(t, path).Log.Entries, 1)
+    require.NoError(t, w.Write([]Entry{testEntry("http://b/"), testEntry("http://c/")}))
+    require.NoError(t, w.Close())
+
+    har := readHar(t, path)
+    assert.Equal(t, "1.2", har.Log.Version)
+    assert.Equal(t, "GoProxy", har.Log.Creator.Name)
+    require.Len(t, har.Log.Entries, 3)
+    assert.Equal(t, "http://c/", har.Log.Entries[2].Request.Url)
+
+    // Reopening the file keeps the previous document
+    w, err = NewFileWriter(path)
+    require.NoError(t, err)
+    defer w.Close()
+    rotated, err := filepath.Glob(filepath.Join(filepath.Dir(path), "proxy-*.har"))
+    require.NoError(t, err)
+    require.Len(t, rotated, 1)
+    assert.Len(t, readHar(t, rotated[0]).Log.Entries, 3)
+    assert.Empty(t, readHar(t, path).Log.Entries)
+}
+
+func TestFileWriterRotation(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "proxy.har")
+    w, err := NewFileWriter(path, WithMaxFileSize(1))
+    require.NoError(t, err)
+    for _, u := range []string{"http://a/", "http://b/", "http://c/"} {
+        require.NoError(t, w.Write([]Entry{testEntry(u)}))
+        // Rotated files are named after the time of their rotation
+        time.Sleep(2 * time.Millisecond)
+    }
+    require.NoError(t, w.Close())
+
+    files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+    require.NoError(t, err)
+    require.Len(t, files, 3, "each entry should be in its own file")
+    var urls []string
+    for _, file := range files {
+        for _, entry := range readHar(t, file).Log.Entries {
+            urls = append(urls, entry.Request.Url)
+        }
+    }
+    assert.ElementsMatch(t, []string{"http://a/", "http://b/", "http://c/"}, urls)
+}
+
+func TestFileWriterFailedRotation(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "proxy.har")
+    w, err := NewFileWriter(path, WithMaxFileSize(1))
+    require.NoError(t, err)
+    require.NoError(t, w.Write([]Entry{testEntry("http://a/")}))
+
+    // The file can't be renamed once removed, so it is kept being written to
+    require.NoError(t, os.Remove(path))
+    assert.Error(t, w.Write([]Entry{testEntry("http://b/")}))
+
+    require.NoError(t, os.WriteFile(path, nil, 0o644))
+    time.Sleep(2 * time.Millisecond)
+    require.NoError(t, w.Write([]Entry{testEntry("http://c/")}))
+    require.NoError(t, w.Close())
+    entries := readHar(t, path).Log.Entries
+    require.Len(t, entries, 1)
+    assert.Equal(t, "http://c/", entries[0].Request.Url)
+}
+
+func TestFileWriterJSONL(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "proxy.jsonl")
+    w, err := NewFileWriter(path, WithFormat(FormatJSONL))
+    require.NoError(t, err)
+    require.NoError(t, w.Write([]Entry{testEntry("http://a/"), testEntry("http://b/")}))
+    require.NoError(t, w.Write([]Entry{testEntry("http://c/")}))
+    require.NoError(t, w.Close())
+
+    data, err := os.ReadFile(path)
+    require.NoError(t, err)
+    lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+    require.Len(t, lines, 2)
+    var har Har
+    require.NoError(t, json.Unmarshal([]byte(lines[1]), &har))
+    require.Len(t, har.Log.Entries, 1)
+    assert.Equal(t, "http://c/", har.Log.Entries[0].Request.Url)
+
+    assert.ErrorIs(t, w.Write([]Entry{testEntry("http://d/")}), os.ErrClosed)
+}
+
+func TestHarLoggerTunnelEntries(t *testing.T) {
+    entries := make(chan Entry, 1)
+    logger := NewLogger(func(exported []Entry) {
+        entries <- exported[0]
+    }, WithExportThreshold(1))
+    defer logger.Stop()
+
+    background := httptest.NewServer(ConstantHandler("tunneled"))
+    defer background.Close()
+    proxy := goproxy.NewProxyHttpServer()
+    // The callback of an earlier handler is kept
+    closed := make(chan string, 1)
+    proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+        ctx.OnTunnelClose = func(stats goproxy.TunnelStats) {
+            closed <- stats.Host
+        }
+        return nil, host
+    })
+    proxy.OnRequest().HandleConnect(logger)
+    proxyServer := httptest.NewServer(proxy)
+    defer proxyServer.Close()
+
+    proxyURL, _ := url.Parse(proxyServer.URL)
+    backgroundURL, _ := url.Parse(background.URL)
+    conn, err := net.Dial("tcp", proxyURL.Host)
+    require.NoError(t, err)
+    defer conn.Close()
+    _, err = io.WriteString(conn, "CONNECT "+backgroundURL.Host+" HTTP/1.1\r\nHost: "+backgroundURL.Host+"\r\n\r\n")
+    require.NoError(t, err)
+    br := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(br, nil)
+    require.NoError(t, err)
+    require.Equal(t, http.StatusOK, resp.StatusCode)
+
+    req := "GET / HTTP/1.1\r\nHost: " + backgroundURL.Host + "\r\nConnection: close\r\n\r\n"
+    _, err = io.WriteString(conn, req)
+    require.NoError(t, err)
+    received, err := io.ReadAll(br)
+    require.NoError(t, err)
+    _ = conn.Close()
+
+    select {
+    case entry := <-entries:
+        assert.Equal(t, http.MethodConnect, entry.Request.Method)
+        assert.Equal(t, "https://"+backgroundURL.Host+"/", entry.Request.Url)
+        assert.Equal(t, int64(len(req)), entry.Request.BodySize)
+        assert.Equal(t, int64(len(received)), entry.Response.BodySize)
+        assert.Equal(t, entry.Time, entry.Timings.Receive)
+    case <-time.After(time.Second):
+        t.Fatal("No tunnel entry exported")
+    }
+    select {
+    case host := <-closed:
+        assert.Equal(t, backgroundURL.Host, host)
+    case <-time.After(time.Second):
+        t.Fatal("Previous OnTunnelClose not called")
+    }
+}
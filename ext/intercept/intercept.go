@@ -0,0 +1,467 @@
+// Package intercept pauses the requests and responses going through a
+// goproxy proxy, so that they can be inspected, edited, answered or dropped
+// by an external controller before they resume.
+//
+// The flows to pause are selected with the conditions of the handlers:
+//
+//	i := intercept.New(intercept.WithTimeout(time.Minute))
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest(goproxy.ReqHostIs("api.example:443")).DoFunc(i.OnRequest)
+//	proxy.OnResponse(goproxy.StatusCodeIs(500)).DoFunc(i.OnResponse)
+//	admin.Handle("/intercept/", http.StripPrefix("/intercept", i))
+//
+// The controller lists the paused flows with GET /flows, and decides what
+// happens to one of them by POSTing a Decision to /flows/{id}. Flows that
+// aren't decided upon in time get the default action, so that nothing hangs
+// forever.
+package intercept
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Phase is the phase a flow is paused in.
+type Phase string
+
+const (
+	// RequestPhase flows are paused before the request is forwarded.
+	RequestPhase Phase = "request"
+	// ResponsePhase flows are paused before the response is sent to the client.
+	ResponsePhase Phase = "response"
+)
+
+// Action is what happens to a paused flow.
+type Action string
+
+const (
+	// Resume lets the flow continue, with the edits of the Decision.
+	Resume Action = "resume"
+	// Drop breaks the connection to the client.
+	Drop Action = "drop"
+	// Answer sends the response of the Decision to the client. In the
+	// request phase, the request isn't forwarded.
+	Answer Action = "answer"
+)
+
+// ErrDropped is the error returned by the response bodies of dropped flows.
+var ErrDropped = errors.New("intercept: flow dropped")
+
+// ErrUnknownFlow is returned when deciding upon a flow that isn't paused.
+var ErrUnknownFlow = errors.New("intercept: unknown flow")
+
+// Base64 is the encoding of the bodies that aren't valid UTF-8 text, in
+// flows and decisions, since JSON strings can't carry them as they are.
+const Base64 = "base64"
+
+// Flow is a paused request or response.
+type Flow struct {
+	ID      string      `json:"id"`
+	Session int64       `json:"session"`
+	Phase   Phase       `json:"phase"`
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header"`
+	// Body is the body of the request or of the response, depending on the
+	// phase, up to the size configured with WithMaxBodySize.
+	Body string `json:"body"`
+	// Encoding is Base64 when Body is base64 encoded, empty otherwise
+	Encoding      string    `json:"encoding,omitempty"`
+	BodyTruncated bool      `json:"body_truncated,omitempty"`
+	PausedAt      time.Time `json:"paused_at"`
+}
+
+// Decision is what the controller decides for a paused flow. Its empty
+// fields leave the flow unchanged.
+type Decision struct {
+	// Action defaults to Resume
+	Action Action `json:"action,omitempty"`
+	// Method and URL replace those of the request, in the request phase.
+	// URL must be absolute.
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Status replaces the status of the response, or is the status of the
+	// answer, 200 by default
+	Status int `json:"status,omitempty"`
+	// Header replaces all the headers of the request or of the response
+	Header http.Header `json:"header,omitempty"`
+	// Body replaces the body of the request or of the response
+	Body *string `json:"body,omitempty"`
+	// Encoding is Base64 when Body is base64 encoded, empty otherwise
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type pausedFlow struct {
+	flow     Flow
+	decision chan Decision
+}
+
+// Interceptor pauses flows until they are decided upon.
+type Interceptor struct {
+	timeout       time.Duration
+	defaultAction Action
+	maxBodySize   int64
+
+	mux *http.ServeMux
+
+	mtx    sync.Mutex
+	flows  map[string]*pausedFlow
+	lastID int64
+}
+
+// Option is a function type for configuring the Interceptor.
+type Option func(*Interceptor)
+
+// WithTimeout sets how long a flow stays paused before getting the default
+// action. Defaults to 5 minutes.
+func WithTimeout(d time.Duration) Option {
+	return func(i *Interceptor) {
+		i.timeout = d
+	}
+}
+
+// WithDefaultAction sets the action of the flows that time out, Resume or
+// Drop. Defaults to Resume.
+func WithDefaultAction(action Action) Option {
+	return func(i *Interceptor) {
+		i.defaultAction = action
+	}
+}
+
+// WithMaxBodySize sets how much of the bodies is shown in flows.
+// Defaults to 1MB.
+func WithMaxBodySize(n int64) Option {
+	return func(i *Interceptor) {
+		i.maxBodySize = n
+	}
+}
+
+// New creates an Interceptor.
+func New(opts ...Option) *Interceptor {
+	i := &Interceptor{
+		timeout:       5 * time.Minute,
+		defaultAction: Resume,
+		maxBodySize:   1 << 20,
+		flows:         make(map[string]*pausedFlow),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	i.mux = http.NewServeMux()
+	i.mux.HandleFunc("GET /flows", i.listFlows)
+	i.mux.HandleFunc("GET /flows/{id}", i.getFlow)
+	i.mux.HandleFunc("POST /flows/{id}", i.decideFlow)
+	return i
+}
+
+// Flows returns the paused flows, oldest first.
+func (i *Interceptor) Flows() []Flow {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	flows := make([]Flow, 0, len(i.flows))
+	for _, f := range i.flows {
+		flows = append(flows, f.flow)
+	}
+	sort.Slice(flows, func(a, b int) bool {
+		return flows[a].PausedAt.Before(flows[b].PausedAt)
+	})
+	return flows
+}
+
+// Decide resumes the paused flow with the given id according to d.
+func (i *Interceptor) Decide(id string, d Decision) error {
+	switch d.Action {
+	case "":
+		d.Action = Resume
+	case Resume, Drop, Answer:
+	default:
+		return errors.New("intercept: unknown action " + strconv.Quote(string(d.Action)))
+	}
+	if d.URL != "" {
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return errors.New("intercept: url " + strconv.Quote(d.URL) + " is not absolute")
+		}
+	}
+	switch d.Encoding {
+	case "":
+	case Base64:
+		if d.Body != nil {
+			body, err := base64.StdEncoding.DecodeString(*d.Body)
+			if err != nil {
+				return err
+			}
+			decoded := string(body)
+			d.Body = &decoded
+		}
+		d.Encoding = ""
+	default:
+		return errors.New("intercept: unknown encoding " + strconv.Quote(d.Encoding))
+	}
+	i.mtx.Lock()
+	f, ok := i.flows[id]
+	delete(i.flows, id)
+	i.mtx.Unlock()
+	if !ok {
+		return ErrUnknownFlow
+	}
+	f.decision <- d
+	return nil
+}
+
+// peekBody reads the beginning of body for display, returning it with its
+// encoding and a body equivalent to the original one.
+func (i *Interceptor) peekBody(body io.ReadCloser) (string, string, bool, io.ReadCloser) {
+	if body == nil || body == http.NoBody {
+		return "", "", false, body
+	}
+	head, err := io.ReadAll(io.LimitReader(body, i.maxBodySize+1))
+	truncated := int64(len(head)) > i.maxBodySize
+	if truncated {
+		head = head[:i.maxBodySize]
+	}
+	var rest io.Reader = body
+	if err != nil {
+		rest = &errorReader{err: err}
+	}
+	text, encoding := string(head), ""
+	if !utf8.Valid(head) {
+		text, encoding = base64.StdEncoding.EncodeToString(head), Base64
+	}
+	return text, encoding, truncated, &readCloser{Reader: io.MultiReader(bytes.NewReader(head), rest), Closer: body}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// pause waits for the decision on flow.
+func (i *Interceptor) pause(flow Flow, ctx *goproxy.ProxyCtx) Decision {
+	f := &pausedFlow{flow: flow, decision: make(chan Decision, 1)}
+	i.mtx.Lock()
+	i.lastID++
+	f.flow.ID = strconv.FormatInt(i.lastID, 10)
+	f.flow.PausedAt = time.Now()
+	i.flows[f.flow.ID] = f
+	i.mtx.Unlock()
+	ctx.Logf("intercept: paused %s of %s %s as flow %s", flow.Phase, flow.Method, flow.URL, f.flow.ID)
+
+	timer := time.NewTimer(i.timeout)
+	defer timer.Stop()
+	var done <-chan struct{}
+	if ctx.Req != nil {
+		done = ctx.Req.Context().Done()
+	}
+	select {
+	case d := <-f.decision:
+		ctx.Logf("intercept: flow %s decided: %s", f.flow.ID, d.Action)
+		return d
+	case <-timer.C:
+		ctx.Warnf("intercept: flow %s timed out, applying default action %s", f.flow.ID, i.defaultAction)
+	case <-done:
+	}
+	i.mtx.Lock()
+	delete(i.flows, f.flow.ID)
+	i.mtx.Unlock()
+	// A decision may have been made concurrently
+	select {
+	case d := <-f.decision:
+		return d
+	default:
+	}
+	return Decision{Action: i.defaultAction}
+}
+
+// OnRequest pauses the request until it is decided upon.
+func (i *Interceptor) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	body, encoding, truncated, rc := i.peekBody(req.Body)
+	req.Body = rc
+	d := i.pause(Flow{
+		Session:       ctx.Session,
+		Phase:         RequestPhase,
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		Header:        req.Header.Clone(),
+		Body:          body,
+		Encoding:      encoding,
+		BodyTruncated: truncated,
+	}, ctx)
+
+	switch d.Action {
+	case Drop:
+		return req, droppedResponse(req)
+	case Answer:
+		return req, answer(req, d)
+	}
+	if d.Method != "" {
+		req.Method = d.Method
+	}
+	if d.URL != "" {
+		u, _ := url.Parse(d.URL)
+		req.URL = u
+		req.Host = u.Host
+	}
+	if d.Header != nil {
+		req.Header = d.Header
+	}
+	if d.Body != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		req.Body = io.NopCloser(bytes.NewBufferString(*d.Body))
+		req.ContentLength = int64(len(*d.Body))
+		req.Header.Del("Transfer-Encoding")
+		req.TransferEncoding = nil
+		req.Header.Set("Content-Length", strconv.Itoa(len(*d.Body)))
+	}
+	return req, nil
+}
+
+// OnResponse pauses the response until it is decided upon. Responses
+// sent by the Interceptor itself aren't paused.
+func (i *Interceptor) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	if _, ok := resp.Body.(*answerBody); ok {
+		return resp
+	}
+	body, encoding, truncated, rc := i.peekBody(resp.Body)
+	resp.Body = rc
+	d := i.pause(Flow{
+		Session:       ctx.Session,
+		Phase:         ResponsePhase,
+		Method:        ctx.Req.Method,
+		URL:           ctx.Req.URL.String(),
+		Status:        resp.StatusCode,
+		Header:        resp.Header.Clone(),
+		Body:          body,
+		Encoding:      encoding,
+		BodyTruncated: truncated,
+	}, ctx)
+
+	switch d.Action {
+	case Drop:
+		_ = resp.Body.Close()
+		return droppedResponse(ctx.Req)
+	case Answer:
+		_ = resp.Body.Close()
+		return answer(ctx.Req, d)
+	}
+	if d.Status != 0 {
+		resp.StatusCode = d.Status
+		resp.Status = strconv.Itoa(d.Status) + " " + http.StatusText(d.Status)
+	}
+	if d.Header != nil {
+		resp.Header = d.Header
+	}
+	if d.Body != nil {
+		_ = resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewBufferString(*d.Body))
+		resp.ContentLength = int64(len(*d.Body))
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+func answer(req *http.Request, d Decision) *http.Response {
+	status := d.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := ""
+	if d.Body != nil {
+		body = *d.Body
+	}
+	resp := goproxy.NewResponse(req, "", status, body)
+	resp.Header.Del("Content-Type")
+	for name, values := range d.Header {
+		resp.Header[name] = values
+	}
+	resp.Body = &answerBody{resp.Body}
+	return resp
+}
+
+// answerBody is the body of the responses sent by the Interceptor.
+type answerBody struct {
+	io.ReadCloser
+}
+
+// droppedResponse returns a response whose body fails right away, which
+// makes the proxy break the connection to the client.
+func droppedResponse(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, "", http.StatusBadGateway, "")
+	resp.Body = &answerBody{io.NopCloser(&errorReader{err: ErrDropped})}
+	resp.ContentLength = -1
+	return resp
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// ServeHTTP implements the controller API:
+//
+//	GET /flows: lists the paused flows
+//	GET /flows/{id}: returns a paused flow
+//	POST /flows/{id}: decides upon a paused flow, with a JSON Decision
+func (i *Interceptor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.mux.ServeHTTP(w, r)
+}
+
+func (i *Interceptor) listFlows(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, i.Flows())
+}
+
+func (i *Interceptor) getFlow(w http.ResponseWriter, r *http.Request) {
+	for _, f := range i.Flows() {
+		if f.ID == r.PathValue("id") {
+			writeJSON(w, f)
+			return
+		}
+	}
+	http.Error(w, ErrUnknownFlow.Error(), http.StatusNotFound)
+}
+
+func (i *Interceptor) decideFlow(w http.ResponseWriter, r *http.Request) {
+	var d Decision
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := i.Decide(r.PathValue("id"), d)
+	switch {
+	case errors.Is(err, ErrUnknownFlow):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
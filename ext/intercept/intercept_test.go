@@ -0,0 +1,182 @@
+package intercept_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/intercept"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type result struct {
+	status int
+	body   string
+	err    error
+}
+
+type fixture struct {
+	client *http.Client
+	admin  *httptest.Server
+	origin *httptest.Server
+}
+
+func newFixture(t *testing.T, newServer func(http.Handler) *httptest.Server, i *intercept.Interceptor) *fixture {
+	t.Helper()
+	origin := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Origin", "yes")
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Edited")+" "+string(body))
+	}))
+	t.Cleanup(origin.Close)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlHasPrefix("127.0.0.1")).DoFunc(i.OnRequest)
+	proxy.OnResponse().DoFunc(i.OnResponse)
+	client := proxytest.NewClient(t, proxy)
+	// Otherwise the transport retries dropped requests on a new connection
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+	admin := httptest.NewServer(i)
+	t.Cleanup(admin.Close)
+	return &fixture{client: client, admin: admin, origin: origin}
+}
+
+func (f *fixture) send(method, path, body string) <-chan result {
+	ch := make(chan result, 1)
+	go func() {
+		req, err := http.NewRequestWithContext(context.Background(), method, f.origin.URL+path, strings.NewReader(body))
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		resp, err := f.client.Do(req)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		ch <- result{status: resp.StatusCode, body: string(b), err: err}
+	}()
+	return ch
+}
+
+// waitFlow polls the controller API until a flow is paused in the given phase.
+func (f *fixture) waitFlow(t *testing.T, phase intercept.Phase) intercept.Flow {
+	t.Helper()
+	var flow intercept.Flow
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(f.admin.URL + "/flows") //nolint:noctx
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var flows []intercept.Flow
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&flows))
+		for _, fl := range flows {
+			if fl.Phase == phase {
+				flow = fl
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 5*time.Millisecond)
+	return flow
+}
+
+func (f *fixture) decide(t *testing.T, id, decision string) int {
+	t.Helper()
+	resp, err := http.Post(f.admin.URL+"/flows/"+id, "application/json", strings.NewReader(decision)) //nolint:noctx
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestIntercept(t *testing.T) {
+	for name, newServer := range map[string]func(http.Handler) *httptest.Server{
+		"http": httptest.NewServer,
+		"mitm": httptest.NewTLSServer,
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t, newServer, intercept.New())
+
+			// Edit the request, then the response
+			ch := f.send(http.MethodPost, "/a", "original")
+			flow := f.waitFlow(t, intercept.RequestPhase)
+			assert.Equal(t, http.MethodPost, flow.Method)
+			assert.Equal(t, "original", flow.Body)
+			assert.Equal(t, http.StatusNoContent,
+				f.decide(t, flow.ID, `{"url": "`+f.origin.URL+`/b", "header": {"X-Edited": ["yes"]}, "body": "edited"}`))
+			flow = f.waitFlow(t, intercept.ResponsePhase)
+			assert.Equal(t, "POST /b yes edited", flow.Body)
+			assert.Equal(t, "yes", flow.Header.Get("X-Origin"))
+			assert.Equal(t, http.StatusNoContent, f.decide(t, flow.ID, `{"status": 201}`))
+			res := <-ch
+			require.NoError(t, res.err)
+			assert.Equal(t, http.StatusCreated, res.status)
+			assert.Equal(t, "POST /b yes edited", res.body)
+
+			// Answer the request without forwarding it
+			ch = f.send(http.MethodGet, "/c", "")
+			flow = f.waitFlow(t, intercept.RequestPhase)
+			assert.Equal(t, http.StatusNoContent, f.decide(t, flow.ID, `{"action": "answer", "status": 418, "body": "teapot"}`))
+			res = <-ch
+			require.NoError(t, res.err)
+			assert.Equal(t, http.StatusTeapot, res.status)
+			assert.Equal(t, "teapot", res.body)
+
+			// Drop the response
+			ch = f.send(http.MethodGet, "/d", "")
+			flow = f.waitFlow(t, intercept.RequestPhase)
+			f.decide(t, flow.ID, `{}`)
+			flow = f.waitFlow(t, intercept.ResponsePhase)
+			f.decide(t, flow.ID, `{"action": "drop"}`)
+			require.Error(t, (<-ch).err)
+
+			assert.Equal(t, http.StatusNotFound, f.decide(t, flow.ID, `{}`))
+			assert.Equal(t, http.StatusBadRequest, f.decide(t, "1", `{"action": "explode"}`))
+			assert.Equal(t, http.StatusBadRequest, f.decide(t, "1", `{"url": "/relative"}`))
+			assert.Equal(t, http.StatusBadRequest, f.decide(t, "1", `{"body": "!", "encoding": "base64"}`))
+		})
+	}
+}
+
+func TestInterceptBinaryBodies(t *testing.T) {
+	f := newFixture(t, httptest.NewServer, intercept.New())
+
+	ch := f.send(http.MethodPost, "/a", "\xff\x00")
+	flow := f.waitFlow(t, intercept.RequestPhase)
+	assert.Equal(t, intercept.Base64, flow.Encoding)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("\xff\x00")), flow.Body)
+	edited := base64.StdEncoding.EncodeToString([]byte("\xfe\x01"))
+	assert.Equal(t, http.StatusNoContent, f.decide(t, flow.ID, `{"body": "`+edited+`", "encoding": "base64"}`))
+
+	flow = f.waitFlow(t, intercept.ResponsePhase)
+	assert.Equal(t, intercept.Base64, flow.Encoding)
+	body, err := base64.StdEncoding.DecodeString(flow.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /a  \xfe\x01", string(body))
+	assert.Equal(t, http.StatusNoContent, f.decide(t, flow.ID, `{}`))
+	res := <-ch
+	require.NoError(t, res.err)
+	assert.Equal(t, "POST /a  \xfe\x01", res.body)
+}
+
+func TestInterceptTimeout(t *testing.T) {
+	f := newFixture(t, httptest.NewServer, intercept.New(
+		intercept.WithTimeout(50*time.Millisecond),
+		intercept.WithDefaultAction(intercept.Drop)))
+
+	start := time.Now()
+	res := <-f.send(http.MethodGet, "/", "")
+	require.Error(t, res.err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
@@ -0,0 +1,48 @@
+// Package proxytest holds the helpers shared by the tests of the ext packages.
+package proxytest
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/require"
+)
+
+// NewClient serves proxy until the end of the test, and returns a client
+// sending its requests through it, accepting any certificate so that hosts
+// can be MITM'd.
+func NewClient(t testing.TB, proxy *goproxy.ProxyHttpServer) *http.Client {
+	t.Helper()
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+
+	proxyURL, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+// Do sends a request with body and header using client, and returns its
+// response along with its body, failing the test on errors.
+func Do(t testing.TB, client *http.Client, method, target, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), method, target, strings.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(respBody)
+}
@@ -0,0 +1,75 @@
+// Package replay holds the request matching shared by the ext packages
+// answering requests with recorded or stubbed responses.
+package replay
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ReadBody reads the body of req, leaving an identical one in its place.
+func ReadBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// Pick returns the index of the first matching exchange that hasn't been
+// replayed yet, marking it as replayed, so that identical requests are
+// answered in the recorded order. Once they all have been, it returns the
+// last matching exchange, and -1 when none matches. The caller must
+// serialize the calls for the same replayed slice.
+func Pick(replayed []bool, match func(n int) bool) int {
+	last := -1
+	for n := range replayed {
+		if !match(n) {
+			continue
+		}
+		if !replayed[n] {
+			replayed[n] = true
+			return n
+		}
+		last = n
+	}
+	return last
+}
+
+// Misses records the requests that didn't match any exchange.
+type Misses struct {
+	mtx    sync.Mutex
+	misses []string
+}
+
+// Handle records the miss of req, then forwards req when passthrough is
+// set, or answers it with a response of the given status otherwise. The
+// logged messages and the response body start with message, for example
+// "vcr: no recorded request matches".
+func (m *Misses) Handle(req *http.Request, ctx *goproxy.ProxyCtx, message string,
+	passthrough bool, status int,
+) (*http.Request, *http.Response) {
+	miss := req.Method + " " + req.URL.String()
+	m.mtx.Lock()
+	m.misses = append(m.misses, miss)
+	m.mtx.Unlock()
+	if passthrough {
+		ctx.Logf("%s %s, forwarding it", message, miss)
+		return req, nil
+	}
+	ctx.Warnf("%s %s", message, miss)
+	return req, goproxy.NewResponse(req, goproxy.ContentTypeText, status, message+" "+miss)
+}
+
+// List returns the recorded misses, as "METHOD URL" strings.
+func (m *Misses) List() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]string(nil), m.misses...)
+}
@@ -0,0 +1,66 @@
+package replay_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/replay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPick(t *testing.T) {
+	recorded := []string{"a", "b", "a", "a"}
+	replayed := make([]bool, len(recorded))
+	pick := func(name string) int {
+		return replay.Pick(replayed, func(n int) bool {
+			return recorded[n] == name
+		})
+	}
+	// Matching exchanges are replayed in order, the last one repeated
+	assert.Equal(t, 0, pick("a"))
+	assert.Equal(t, 2, pick("a"))
+	assert.Equal(t, 1, pick("b"))
+	assert.Equal(t, 3, pick("a"))
+	assert.Equal(t, 3, pick("a"))
+	assert.Equal(t, 1, pick("b"))
+	assert.Equal(t, -1, pick("c"))
+}
+
+func TestReadBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+	body, err := replay.ReadBody(req)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	again, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(again), "the body is left to be read again")
+
+	body, err = replay.ReadBody(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestMisses(t *testing.T) {
+	var misses replay.Misses
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+	_, resp := misses.Handle(req, ctx, "test: no match for", false, http.StatusNotFound)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "test: no match for GET http://example.com/a", string(body))
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/b", nil)
+	forwarded, resp := misses.Handle(req, ctx, "test: no match for", true, http.StatusNotFound)
+	assert.Nil(t, resp)
+	assert.Same(t, req, forwarded)
+
+	assert.Equal(t, []string{"GET http://example.com/a", "POST http://example.com/b"}, misses.List())
+}
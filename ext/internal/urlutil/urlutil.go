@@ -0,0 +1,31 @@
+// Package urlutil holds the URL helpers shared by the ext packages.
+package urlutil
+
+import (
+	"net/url"
+	"strings"
+)
+
+// StripDefaultPort returns a copy of u without the port of its host when it
+// is the default one of its scheme, which the URLs of MITM'd requests have.
+func StripDefaultPort(u *url.URL) *url.URL {
+	v := *u
+	if port := u.Port(); (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		v.Host = u.Hostname()
+		if strings.Contains(v.Host, ":") {
+			// IPv6 addresses keep their brackets
+			v.Host = "[" + v.Host + "]"
+		}
+	}
+	return &v
+}
+
+// Normalize returns u as a string without the default port of its scheme,
+// which MITM'd requests have, and without its fragment, which browsers may
+// record, so that the URLs of the same resource compare equal.
+func Normalize(u *url.URL) string {
+	n := StripDefaultPort(u)
+	n.Fragment = ""
+	n.RawFragment = ""
+	return n.String()
+}
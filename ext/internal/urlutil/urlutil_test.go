@@ -0,0 +1,42 @@
+package urlutil_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy/ext/internal/urlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripDefaultPort(t *testing.T) {
+	testCases := map[string]string{
+		"https://example.com:443/path?q=1": "https://example.com/path?q=1",
+		"http://example.com:80/":           "http://example.com/",
+		"http://example.com:443/":          "http://example.com:443/",
+		"https://example.com:8443/":        "https://example.com:8443/",
+		"https://[::1]:443/path":           "https://[::1]/path",
+		"http://[2001:db8::1]:80/":         "http://[2001:db8::1]/",
+		"https://[::1]:8443/path":          "https://[::1]:8443/path",
+		"https://example.com/path":         "https://example.com/path",
+	}
+	for raw, expected := range testCases {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		assert.Equal(t, expected, urlutil.StripDefaultPort(u).String(), raw)
+		assert.Equal(t, raw, u.String(), "the URL is not modified")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	testCases := map[string]string{
+		"https://example.com:443/path?q=1#top": "https://example.com/path?q=1",
+		"http://example.com:8080/#":            "http://example.com:8080/",
+		"https://[::1]:443/path#a%20b":         "https://[::1]/path",
+	}
+	for raw, expected := range testCases {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		assert.Equal(t, expected, urlutil.Normalize(u), raw)
+	}
+}
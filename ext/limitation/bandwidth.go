@@ -0,0 +1,260 @@
+package limitation
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Bandwidth is a goproxy.Throttle limiting throughput to a number of bytes
+// per second, with bursts of up to a number of bytes after being idle.
+type Bandwidth struct {
+	mtx    sync.Mutex
+	bucket *tokenBucket
+}
+
+// NewBandwidth creates a Bandwidth of bytesPerSecond, allowing bursts of burst bytes.
+// It panics if bytesPerSecond or burst is not positive.
+func NewBandwidth(bytesPerSecond, burst int) *Bandwidth {
+	if bytesPerSecond <= 0 {
+		panic("limitation: non-positive rate " + strconv.Itoa(bytesPerSecond))
+	}
+	if burst <= 0 {
+		panic("limitation: non-positive burst " + strconv.Itoa(burst))
+	}
+	return &Bandwidth{bucket: newTokenBucket(float64(bytesPerSecond), float64(burst), time.Now())}
+}
+
+// WaitN implements goproxy.Throttle.
+func (b *Bandwidth) WaitN(ctx context.Context, n int) error {
+	b.mtx.Lock()
+	wait := b.bucket.reserve(time.Now(), float64(n))
+	b.mtx.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give back the bytes that won't be transferred
+		b.mtx.Lock()
+		b.bucket.tokens = math.Min(b.bucket.burst, b.bucket.tokens+float64(n))
+		b.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// idle reports whether the bucket is full, hence equivalent to a new one.
+func (b *Bandwidth) idle(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.bucket.refill(now)
+	return b.bucket.tokens >= b.bucket.burst
+}
+
+// Throttles waits on every throttle in turn, so that the slowest one applies.
+type Throttles []goproxy.Throttle
+
+// WaitN implements goproxy.Throttle.
+func (t Throttles) WaitN(ctx context.Context, n int) error {
+	for _, throttle := range t {
+		if err := throttle.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scope defines which traffic shares the bandwidth of a Shaper.
+type Scope int
+
+const (
+	// PerConnection gives its own bandwidth to every request, CONNECT tunnel
+	// or MITM'd connection.
+	PerConnection Scope = iota
+	// PerClient shares the bandwidth between the traffic of the same client,
+	// identified by the key function of the Shaper.
+	PerClient
+	// Global shares the bandwidth between all the traffic of the proxy.
+	Global
+)
+
+// Shaper limits the upstream and downstream bandwidth of the traffic it
+// handles. It can be restricted to part of the traffic with ReqConditions,
+// and several shapers can be combined, e.g. to limit both each client and
+// the whole proxy:
+//
+//	shaper := limitation.NewShaper(64<<10, 256<<10, limitation.WithScope(limitation.PerClient))
+//	proxy.OnRequest(goproxy.ReqHostIs("slow.example:443")).HandleConnect(shaper)
+//	proxy.OnRequest(goproxy.ReqHostIs("slow.example")).DoFunc(shaper.OnRequest)
+type Shaper struct {
+	upstream   int
+	downstream int
+	burst      time.Duration
+	scope      Scope
+	key        KeyFunc
+
+	mtx       sync.Mutex
+	clients   map[string]*shaperThrottles
+	lastSweep time.Time
+	global    *shaperThrottles
+}
+
+// ShaperOption is a function type for configuring the Shaper.
+type ShaperOption func(*Shaper)
+
+// WithScope sets which traffic shares the bandwidth. Defaults to PerConnection.
+func WithScope(scope Scope) ShaperOption {
+	return func(s *Shaper) {
+		s.scope = scope
+	}
+}
+
+// WithShaperKey sets the function identifying clients for the PerClient scope.
+// Defaults to ByClientIP.
+func WithShaperKey(key KeyFunc) ShaperOption {
+	return func(s *Shaper) {
+		s.key = key
+	}
+}
+
+// WithBurstDuration sets for how long traffic may go at full speed after
+// being idle, as a duration of traffic at the configured rate. Defaults to 100ms.
+func WithBurstDuration(d time.Duration) ShaperOption {
+	return func(s *Shaper) {
+		s.burst = d
+	}
+}
+
+// NewShaper creates a Shaper limiting the traffic sent to destination servers
+// to upstream bytes per second, and the traffic sent to clients to downstream
+// bytes per second. A rate of 0 leaves the direction unlimited.
+func NewShaper(upstream, downstream int, opts ...ShaperOption) *Shaper {
+	s := &Shaper{
+		upstream:   upstream,
+		downstream: downstream,
+		burst:      100 * time.Millisecond,
+		key:        ByClientIP,
+		clients:    make(map[string]*shaperThrottles),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.global = s.newThrottles()
+	return s
+}
+
+// shaperThrottles are the throttles handed out by a Shaper, which remember
+// it to avoid shaping the requests of a MITM'd connection twice.
+type shaperThrottles struct {
+	shaper     *Shaper
+	upstream   *Bandwidth
+	downstream *Bandwidth
+}
+
+type shaperThrottle struct {
+	shaper *Shaper
+	*Bandwidth
+}
+
+func (s *Shaper) newThrottles() *shaperThrottles {
+	bandwidth := func(rate int) *Bandwidth {
+		if rate <= 0 {
+			return nil
+		}
+		burst := max(int(float64(rate)*s.burst.Seconds()), 1)
+		return NewBandwidth(rate, burst)
+	}
+	return &shaperThrottles{shaper: s, upstream: bandwidth(s.upstream), downstream: bandwidth(s.downstream)}
+}
+
+func (s *Shaper) throttles(req *http.Request, ctx *goproxy.ProxyCtx) *shaperThrottles {
+	switch s.scope {
+	case Global:
+		return s.global
+	case PerClient:
+		key := s.key(req, ctx)
+		now := time.Now()
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.sweep(now)
+		t, ok := s.clients[key]
+		if !ok {
+			t = s.newThrottles()
+			s.clients[key] = t
+		}
+		return t
+	default:
+		return s.newThrottles()
+	}
+}
+
+// sweep forgets the clients whose bandwidth is entirely available.
+func (s *Shaper) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, t := range s.clients {
+		if (t.upstream == nil || t.upstream.idle(now)) && (t.downstream == nil || t.downstream.idle(now)) {
+			delete(s.clients, key)
+		}
+	}
+}
+
+// combine adds the throttle of the shaper to current, unless current
+// already holds a throttle of the shaper.
+func (s *Shaper) combine(current goproxy.Throttle, bandwidth *Bandwidth) goproxy.Throttle {
+	if bandwidth == nil {
+		return current
+	}
+	throttle := &shaperThrottle{shaper: s, Bandwidth: bandwidth}
+	switch c := current.(type) {
+	case nil:
+		return throttle
+	case *shaperThrottle:
+		if c.shaper == s {
+			return current
+		}
+		return Throttles{c, throttle}
+	case Throttles:
+		for _, t := range c {
+			if st, ok := t.(*shaperThrottle); ok && st.shaper == s {
+				return current
+			}
+		}
+		return append(c[:len(c):len(c)], throttle)
+	default:
+		return Throttles{c, throttle}
+	}
+}
+
+func (s *Shaper) apply(req *http.Request, ctx *goproxy.ProxyCtx) {
+	t := s.throttles(req, ctx)
+	ctx.UpstreamThrottle = s.combine(ctx.UpstreamThrottle, t.upstream)
+	ctx.DownstreamThrottle = s.combine(ctx.DownstreamThrottle, t.downstream)
+}
+
+// OnRequest shapes the bodies of the request and of its response, and the
+// WebSocket connection it may be upgraded to.
+func (s *Shaper) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	s.apply(req, ctx)
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, shaping the CONNECT tunnel,
+// or the requests of the connection when it is MITM'd. It leaves the choice
+// of the action to the next handlers.
+func (s *Shaper) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	s.apply(ctx.Req, ctx)
+	return nil, host
+}
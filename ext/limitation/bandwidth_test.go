@@ -0,0 +1,94 @@
+package limitation_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/limitation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShaper(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("x", 25<<10))
+	}))
+	defer background.Close()
+
+	testCases := []struct {
+		name    string
+		scope   limitation.Scope
+		minTime time.Duration
+	}{
+		// Each request gets 100KB/s: 25KB minus the 10KB burst takes 150ms
+		{"per connection", limitation.PerConnection, 140 * time.Millisecond},
+		// Both requests share 100KB/s: 50KB minus the 10KB burst takes 400ms
+		{"global", limitation.Global, 390 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shaper := limitation.NewShaper(0, 100<<10, limitation.WithScope(tc.scope))
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().DoFunc(shaper.OnRequest)
+			s := httptest.NewServer(proxy)
+			defer s.Close()
+			client := &http.Client{Transport: &http.Transport{Proxy: func(*http.Request) (*url.URL, error) {
+				return url.Parse(s.URL)
+			}}}
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for range 2 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, background.URL, nil)
+					require.NoError(t, err)
+					resp, err := client.Do(req)
+					require.NoError(t, err)
+					defer resp.Body.Close()
+					n, _ := io.Copy(io.Discard, resp.Body)
+					assert.Equal(t, int64(25<<10), n)
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+			assert.GreaterOrEqual(t, elapsed, tc.minTime)
+			assert.Less(t, elapsed, tc.minTime+time.Second)
+		})
+	}
+}
+
+func TestShapersCombine(t *testing.T) {
+	perClient := limitation.NewShaper(1000, 1000, limitation.WithScope(limitation.PerClient))
+	global := limitation.NewShaper(1000, 1000, limitation.WithScope(limitation.Global))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := &goproxy.ProxyCtx{Req: req}
+
+	// MITM'd requests inherit the throttles of their CONNECT request,
+	// which must not be applied again.
+	perClient.HandleConnect("example.com:443", ctx)
+	perClient.OnRequest(req, ctx)
+	_, combined := ctx.DownstreamThrottle.(limitation.Throttles)
+	assert.False(t, combined)
+
+	global.OnRequest(req, ctx)
+	global.OnRequest(req, ctx)
+	throttles, combined := ctx.UpstreamThrottle.(limitation.Throttles)
+	require.True(t, combined)
+	assert.Len(t, throttles, 2)
+}
+
+func TestBandwidthRejectsNonPositiveRates(t *testing.T) {
+	assert.Panics(t, func() { limitation.NewBandwidth(0, 1) })
+	assert.Panics(t, func() { limitation.NewBandwidth(-1, 1) })
+	assert.Panics(t, func() { limitation.NewBandwidth(1, 0) })
+}
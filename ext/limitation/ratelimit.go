@@ -0,0 +1,254 @@
+package limitation
+
+import (
+	"encoding/base64"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// take removes n tokens from the bucket when available. Otherwise it
+// returns how long to wait until they will be.
+func (b *tokenBucket) take(now time.Time, n float64) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reserve removes n tokens from the bucket, possibly going into debt, and
+// returns how long to wait until the debt is paid off.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// KeyFunc returns the key a request is rate limited by.
+// Requests with an empty key are not limited.
+type KeyFunc func(req *http.Request, ctx *goproxy.ProxyCtx) string
+
+// ByClientIP limits requests per client IP address.
+func ByClientIP(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ByUser limits requests per user name, taken from the Proxy-Authorization
+// header of requests using basic authentication. Since auth.Basic removes
+// this header, the rate limiter must be registered before it. The requests
+// of MITM'd connections, which carry no credentials, are limited by the user
+// of their CONNECT request.
+//
+// The user name is not verified: a client can claim any user, getting a new
+// bucket with each made-up name, or using up the tokens of another user.
+// Only use ByUser when requests are authenticated before reaching the proxy,
+// and ByVerifiedUser otherwise.
+func ByUser(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	user, _, _ := basicCredentials(req, ctx)
+	return user
+}
+
+// ByVerifiedUser limits requests per user name like ByUser, for the
+// credentials accepted by check only, which should be the check of the
+// authentication of the proxy. Requests with other credentials aren't
+// limited, they are left to the authentication to reject.
+func ByVerifiedUser(check func(user, passwd string) bool) KeyFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		user, passwd, ok := basicCredentials(req, ctx)
+		if !ok || !check(user, passwd) {
+			return ""
+		}
+		return user
+	}
+}
+
+// basicCredentials returns the basic authentication credentials of req, or
+// of its CONNECT request for the requests of MITM'd connections.
+func basicCredentials(req *http.Request, ctx *goproxy.ProxyCtx) (user, passwd string, ok bool) {
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" && ctx.ConnectReq != nil {
+		header = ctx.ConnectReq.Header.Get("Proxy-Authorization")
+	}
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || scheme != "Basic" {
+		return "", "", false
+	}
+	userpass, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(userpass), ":")
+}
+
+// ByHost limits requests per destination host.
+func ByHost(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if req.URL != nil && req.URL.Host != "" {
+		return req.URL.Hostname()
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return req.Host
+	}
+	return host
+}
+
+// RateLimiter limits the rate of requests and CONNECT tunnels per key, using
+// a token bucket for each key. Instead of blocking, requests over the limit are
+// answered with a 429 Too Many Requests response holding a Retry-After header.
+//
+//	limiter := limitation.NewRateLimiter(10, limitation.WithBurst(20))
+//	proxy.OnRequest().Do(limiter)
+//	proxy.OnRequest().HandleConnect(limiter)
+type RateLimiter struct {
+	rate     float64
+	burst    int
+	key      KeyFunc
+	response func(req *http.Request, retryAfter time.Duration) *http.Response
+
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// RateLimiterOption is a function type for configuring the RateLimiter.
+type RateLimiterOption func(*RateLimiter)
+
+// WithBurst sets how many requests a key can make at once, after being idle.
+// Defaults to 1.
+func WithBurst(burst int) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.burst = burst
+	}
+}
+
+// WithKeyFunc sets the function returning the key requests are limited by.
+// Defaults to ByClientIP.
+func WithKeyFunc(key KeyFunc) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.key = key
+	}
+}
+
+// WithRejectResponse sets the function building the response sent to
+// limited clients, from the request and the time after which it may be retried.
+func WithRejectResponse(response func(req *http.Request, retryAfter time.Duration) *http.Response) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.response = response
+	}
+}
+
+// TooManyRequests is the default response of a RateLimiter.
+func TooManyRequests(req *http.Request, retryAfter time.Duration) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, "429 Too Many Requests")
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return resp
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate requests per second for each key.
+// It panics if rate is not positive.
+func NewRateLimiter(rate float64, opts ...RateLimiterOption) *RateLimiter {
+	if !(rate > 0) {
+		panic("limitation: non-positive rate " + strconv.FormatFloat(rate, 'g', -1, 64))
+	}
+	l := &RateLimiter{
+		rate:     rate,
+		burst:    1,
+		key:      ByClientIP,
+		response: TooManyRequests,
+		buckets:  make(map[string]*tokenBucket),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Allow consumes a token for key, or returns how long to wait until one is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.rate, float64(l.burst), now)
+		l.buckets[key] = b
+	}
+	return b.take(now, 1)
+}
+
+// sweep forgets the buckets that are full again, since they are
+// equivalent to new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Handle implements goproxy.ReqHandler.
+func (l *RateLimiter) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	key := l.key(req, ctx)
+	if key == "" {
+		return req, nil
+	}
+	if ok, retryAfter := l.Allow(key); !ok {
+		ctx.Logf("Rate limit exceeded for %s", key)
+		return nil, l.response(req, retryAfter)
+	}
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, rejecting the CONNECT
+// requests over the limit and leaving the other ones to the next handlers.
+func (l *RateLimiter) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	key := l.key(ctx.Req, ctx)
+	if key == "" {
+		return nil, host
+	}
+	if ok, retryAfter := l.Allow(key); !ok {
+		ctx.Logf("Rate limit exceeded for %s, rejecting CONNECT to %s", key, host)
+		ctx.Resp = l.response(ctx.Req, retryAfter)
+		return goproxy.RejectConnect, host
+	}
+	return nil, host
+}
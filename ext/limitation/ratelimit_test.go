@@ -0,0 +1,114 @@
+package limitation_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/limitation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+
+	limiter := limitation.NewRateLimiter(0.5, limitation.WithBurst(2))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(limiter)
+	proxy.OnRequest().HandleConnect(limiter)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func() *http.Response {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, background.URL, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, get().StatusCode)
+	assert.Equal(t, http.StatusOK, get().StatusCode)
+	resp := get()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// CONNECT requests share the bucket of the client
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/path", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: goproxy.NewProxyHttpServer()}
+
+	assert.Equal(t, "192.0.2.1", limitation.ByClientIP(req, ctx))
+	assert.Equal(t, "alice", limitation.ByUser(req, ctx))
+	assert.Equal(t, "example.com", limitation.ByHost(req, ctx))
+
+	// The requests of MITM'd connections are limited by the user of the CONNECT
+	mitmReq := httptest.NewRequest(http.MethodGet, "https://example.com/path", nil)
+	mitmCtx := &goproxy.ProxyCtx{Req: mitmReq, ConnectReq: req, Proxy: ctx.Proxy}
+	assert.Equal(t, "alice", limitation.ByUser(mitmReq, mitmCtx))
+	assert.Empty(t, limitation.ByUser(mitmReq, &goproxy.ProxyCtx{Req: mitmReq, Proxy: ctx.Proxy}))
+
+	// Only the credentials accepted by the check give their user
+	check := func(user, passwd string) bool {
+		return user == "alice" && passwd == "secret"
+	}
+	assert.Equal(t, "alice", limitation.ByVerifiedUser(check)(req, ctx))
+	assert.Equal(t, "alice", limitation.ByVerifiedUser(check)(mitmReq, mitmCtx))
+	forged := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	forged.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:guess")))
+	assert.Equal(t, "alice", limitation.ByUser(forged, ctx))
+	assert.Empty(t, limitation.ByVerifiedUser(check)(forged, ctx))
+
+	// Requests without a key are never limited
+	limiter := limitation.NewRateLimiter(0.001, limitation.WithKeyFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		return ""
+	}))
+	for range 3 {
+		_, resp := limiter.Handle(req, ctx)
+		assert.Nil(t, resp)
+	}
+
+	limiter = limitation.NewRateLimiter(0.001, limitation.WithKeyFunc(limitation.ByHost))
+	_, resp := limiter.Handle(req, ctx)
+	assert.Nil(t, resp)
+	_, resp = limiter.Handle(req, ctx)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	other := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	_, resp = limiter.Handle(other, ctx)
+	assert.Nil(t, resp)
+}
+
+func TestRateLimiterRejectsNonPositiveRates(t *testing.T) {
+	assert.Panics(t, func() { limitation.NewRateLimiter(0) })
+	assert.Panics(t, func() { limitation.NewRateLimiter(-1) })
+}
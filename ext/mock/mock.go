@@ -0,0 +1,213 @@
+// Package mock answers the requests going through a goproxy proxy with
+// stubbed responses, declared as data rather than code, and records the
+// calls made to each stub so that tests can verify them afterwards.
+//
+//	m := mock.New()
+//	err := m.Add(mock.Stub{
+//		Name:      "create user",
+//		Request:   mock.Pattern{Method: "POST", URL: `^https://api\.example/users$`, JSON: map[string]any{"user.role": "admin"}},
+//		Responses: []mock.Response{{Status: 201, Body: `{"id": 1}`}, {Status: 409}},
+//	})
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest().DoFunc(m.OnRequest)
+//	...
+//	if n := len(m.Calls("create user")); n != 1 { ... }
+//
+// Requests that don't match any stub are forwarded, unless WithUnmatchedStatus
+// is used, and can be listed with Unmatched.
+package mock
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/replay"
+	"github.com/elazarl/goproxy/ext/internal/urlutil"
+)
+
+// Call is a request received by the proxy.
+type Call struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+	Time   time.Time
+}
+
+type stubState struct {
+	stub    Stub
+	pattern *pattern
+	calls   []Call
+}
+
+// Mock answers requests with the first stub they match.
+type Mock struct {
+	unmatchedStatus int
+
+	mtx       sync.Mutex
+	stubs     []*stubState
+	unmatched []Call
+}
+
+// Option is a function type for configuring the Mock.
+type Option func(*Mock)
+
+// WithUnmatchedStatus answers the requests that don't match any stub with
+// an empty response of the given status, instead of forwarding them.
+func WithUnmatchedStatus(status int) Option {
+	return func(m *Mock) {
+		m.unmatchedStatus = status
+	}
+}
+
+// New creates a Mock without any stub.
+func New(opts ...Option) *Mock {
+	m := &Mock{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Add adds stubs, which are matched after the ones added before. It fails
+// without adding any stub if one of them is invalid.
+func (m *Mock) Add(stubs ...Stub) error {
+	states := make([]*stubState, 0, len(stubs))
+	for _, stub := range stubs {
+		p, err := compile(stub.Request)
+		if err != nil {
+			return err
+		}
+		states = append(states, &stubState{stub: stub, pattern: p})
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.stubs = append(m.stubs, states...)
+	return nil
+}
+
+// Calls returns the requests answered by the stubs with the given name.
+func (m *Mock) Calls(name string) []Call {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var calls []Call
+	for _, s := range m.stubs {
+		if s.stub.Name == name {
+			calls = append(calls, s.calls...)
+		}
+	}
+	return calls
+}
+
+// Unmatched returns the requests that didn't match any stub.
+func (m *Mock) Unmatched() []Call {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]Call(nil), m.unmatched...)
+}
+
+// Reset forgets the recorded calls, and restarts the response sequences.
+func (m *Mock) Reset() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, s := range m.stubs {
+		s.calls = nil
+	}
+	m.unmatched = nil
+}
+
+// OnRequest answers req with the first stub it matches.
+func (m *Mock) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	body, err := replay.ReadBody(req)
+	if err != nil {
+		ctx.Warnf("mock: cannot read body of %v %v: %v", req.Method, req.URL, err)
+		return req, nil
+	}
+	call := Call{Method: req.Method, URL: urlutil.Normalize(req.URL), Header: req.Header.Clone(), Body: body, Time: time.Now()}
+
+	m.mtx.Lock()
+	var matched *stubState
+	for _, s := range m.stubs {
+		if s.pattern.match(req, body) {
+			matched = s
+			break
+		}
+	}
+	if matched == nil {
+		m.unmatched = append(m.unmatched, call)
+		m.mtx.Unlock()
+		if m.unmatchedStatus != 0 {
+			ctx.Warnf("mock: no stub matches %v %v", req.Method, req.URL)
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, m.unmatchedStatus, "")
+		}
+		ctx.Logf("mock: no stub matches %v %v, forwarding it", req.Method, req.URL)
+		return req, nil
+	}
+	matched.calls = append(matched.calls, call)
+	n := len(matched.calls)
+	m.mtx.Unlock()
+
+	responses := matched.stub.Responses
+	if len(responses) == 0 {
+		responses = []Response{{}}
+	}
+	r := responses[min(n, len(responses))-1]
+	ctx.Logf("mock: answering %v %v with stub %q", req.Method, req.URL, matched.stub.Name)
+
+	if r.Delay > 0 {
+		timer := time.NewTimer(time.Duration(r.Delay))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+		}
+	}
+	return req, m.response(req, ctx, r)
+}
+
+func (m *Mock) response(req *http.Request, ctx *goproxy.ProxyCtx, r Response) *http.Response {
+	body := []byte(r.Body)
+	contentType := ""
+	if r.File != "" {
+		var err error
+		if body, err = os.ReadFile(r.File); err != nil {
+			ctx.Warnf("mock: cannot read response file: %v", err)
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		contentType = mime.TypeByExtension(filepath.Ext(r.File))
+	}
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range r.Headers {
+		resp.Header.Set(name, value)
+	}
+	return resp
+}
@@ -0,0 +1,127 @@
+package mock_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/elazarl/goproxy/ext/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonHeader is sent with all the requests of the tests
+var jsonHeader = http.Header{"Content-Type": {"application/json"}}
+
+func newMockProxy(t *testing.T, m *mock.Mock) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(m.OnRequest)
+	return proxytest.NewClient(t, proxy)
+}
+
+func TestStubs(t *testing.T) {
+	m := mock.New(mock.WithUnmatchedStatus(http.StatusNotImplemented))
+	require.NoError(t, m.Add(
+		mock.Stub{
+			Name: "create admin",
+			Request: mock.Pattern{
+				Method:  http.MethodPost,
+				URL:     `^https://api\.example/users$`,
+				Headers: map[string]string{"Content-Type": "application/json"},
+				JSON:    map[string]any{"user.role": "admin", "user.level": 3},
+			},
+			Responses: []mock.Response{
+				{Status: http.StatusCreated, Headers: map[string]string{"Location": "/users/1"}, Body: `{"id": 1}`},
+				{Status: http.StatusConflict},
+			},
+		},
+		mock.Stub{
+			Name:      "search",
+			Request:   mock.Pattern{URL: `/search`, Query: map[string]string{"q": "goproxy"}},
+			Responses: []mock.Response{{Body: "found"}},
+		},
+	))
+	client := newMockProxy(t, m)
+
+	admin := `{"user": {"role": "admin", "level": 3}}`
+	resp, body := proxytest.Do(t, client, http.MethodPost, "https://api.example/users", admin, jsonHeader)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/users/1", resp.Header.Get("Location"))
+	assert.JSONEq(t, `{"id": 1}`, body)
+	for range 2 {
+		resp, _ = proxytest.Do(t, client, http.MethodPost, "https://api.example/users", admin, jsonHeader)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	}
+
+	resp, body = proxytest.Do(t, client, http.MethodGet, "http://search.example/search?q=goproxy", "", jsonHeader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "found", body)
+
+	// Unmatched because of the body, the query and the method
+	resp, _ = proxytest.Do(t, client, http.MethodPost, "https://api.example/users", `{"user": {"role": "guest", "level": 3}}`, jsonHeader)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	proxytest.Do(t, client, http.MethodGet, "http://search.example/search?q=other", "", jsonHeader)
+	proxytest.Do(t, client, http.MethodGet, "https://api.example/users", "", jsonHeader)
+
+	calls := m.Calls("create admin")
+	require.Len(t, calls, 3)
+	assert.JSONEq(t, admin, string(calls[0].Body))
+	assert.Len(t, m.Calls("search"), 1)
+	unmatched := m.Unmatched()
+	require.Len(t, unmatched, 3)
+	assert.Equal(t, "http://search.example/search?q=other", unmatched[1].URL)
+
+	m.Reset()
+	assert.Empty(t, m.Calls("create admin"))
+	resp, _ = proxytest.Do(t, client, http.MethodPost, "https://api.example/users", admin, jsonHeader)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "sequences restart after a reset")
+}
+
+func TestStubsForIPv6Hosts(t *testing.T) {
+	m := mock.New()
+	require.NoError(t, m.Add(mock.Stub{
+		Name:      "ipv6",
+		Request:   mock.Pattern{URL: `^https://\[::1\]/v1$`},
+		Responses: []mock.Response{{Body: "stubbed"}},
+	}))
+	client := newMockProxy(t, m)
+
+	// The stubs answer MITM'd requests without reaching the destination
+	resp, body := proxytest.Do(t, client, http.MethodGet, "https://[::1]/v1", "", jsonHeader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "stubbed", body)
+	require.Len(t, m.Calls("ipv6"), 1)
+	assert.Equal(t, "https://[::1]/v1", m.Calls("ipv6")[0].URL)
+}
+
+func TestStubsFromFile(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "real")
+	}))
+	defer background.Close()
+
+	stubs, err := mock.LoadStubs("testdata/stubs.json")
+	require.NoError(t, err)
+	m := mock.New()
+	require.NoError(t, m.Add(stubs...))
+	client := newMockProxy(t, m)
+
+	start := time.Now()
+	resp, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/logo.txt", "", jsonHeader)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, "goproxy\n", body)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Unmatched requests are forwarded by default
+	_, body = proxytest.Do(t, client, http.MethodGet, background.URL+"/other", "", jsonHeader)
+	assert.Equal(t, "real", body)
+	assert.Len(t, m.Unmatched(), 1)
+
+	assert.Error(t, m.Add(mock.Stub{Request: mock.Pattern{URL: "("}}))
+}
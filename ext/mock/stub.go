@@ -0,0 +1,163 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy/ext/internal/urlutil"
+)
+
+// Stub declares the response to send to the requests matching a pattern.
+type Stub struct {
+	// Name identifies the stub when verifying its calls
+	Name    string  `json:"name"`
+	Request Pattern `json:"request"`
+	// Responses are sent in sequence to the successive matching requests,
+	// the last one being repeated once the others have been sent
+	Responses []Response `json:"responses"`
+}
+
+// Pattern matches requests. Its empty fields match any request.
+type Pattern struct {
+	Method string `json:"method,omitempty"`
+	// URL is a regular expression matched against the full request URL,
+	// without the default port of its scheme nor its fragment
+	URL string `json:"url,omitempty"`
+	// Headers are the values that request headers must have
+	Headers map[string]string `json:"headers,omitempty"`
+	// Query are the values that query parameters must have
+	Query map[string]string `json:"query,omitempty"`
+	// JSON are the values that the fields of a JSON request body must have,
+	// the fields of nested objects being named with dots, e.g. "user.name"
+	JSON map[string]any `json:"json,omitempty"`
+}
+
+// Response is a stubbed response.
+type Response struct {
+	// Status defaults to 200
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// File is the path of a file to send as body, instead of Body
+	File string `json:"file,omitempty"`
+	// Delay is how long to wait before sending the response
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "1.5s" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadStubs reads a JSON array of stubs from a file.
+func LoadStubs(path string) ([]Stub, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stubs []Stub
+	if err := json.Unmarshal(data, &stubs); err != nil {
+		return nil, fmt.Errorf("invalid stubs in %s: %w", path, err)
+	}
+	return stubs, nil
+}
+
+// pattern is a compiled Pattern.
+type pattern struct {
+	Pattern
+	url  *regexp.Regexp
+	json map[string]any
+}
+
+func compile(p Pattern) (*pattern, error) {
+	c := &pattern{Pattern: p}
+	if p.URL != "" {
+		var err error
+		if c.url, err = regexp.Compile(p.URL); err != nil {
+			return nil, err
+		}
+	}
+	if p.JSON != nil {
+		// Normalize the expected values to the types produced by decoding
+		// JSON, e.g. float64 for all numbers
+		data, err := json.Marshal(p.JSON)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &c.json); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (p *pattern) match(req *http.Request, body []byte) bool {
+	if p.Method != "" && !strings.EqualFold(p.Method, req.Method) {
+		return false
+	}
+	if p.url != nil && !p.url.MatchString(urlutil.Normalize(req.URL)) {
+		return false
+	}
+	for name, value := range p.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	query := req.URL.Query()
+	for name, value := range p.Query {
+		if !query.Has(name) || query.Get(name) != value {
+			return false
+		}
+	}
+	if len(p.json) == 0 {
+		return true
+	}
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false
+	}
+	for field, expected := range p.json {
+		value, ok := lookup(doc, field)
+		if !ok || !reflect.DeepEqual(value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value of a dotted field of a decoded JSON document.
+func lookup(doc any, field string) (any, bool) {
+	for _, name := range strings.Split(field, ".") {
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
@@ -0,0 +1,417 @@
+// Package pcap captures the HTTP exchanges going through a goproxy proxy to
+// a pcapng file, including the decrypted content of MITM'd connections, so
+// that they can be inspected with Wireshark without any TLS key.
+//
+//	f, err := os.Create("proxy.pcapng")
+//	...
+//	capture, err := pcap.New(f)
+//	...
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest().DoFunc(capture.OnRequest)
+//	proxy.OnResponse().DoFunc(capture.OnResponse)
+//	...
+//	capture.Close()
+//
+// The exchanges of a client connection with a destination host are written
+// as a synthesized TCP connection, between the address of the client and
+// the one of the destination server, with a handshake and consistent
+// sequence numbers. The content of MITM'd connections keeps the port of
+// the destination, usually 443: use "Decode As..." HTTP in Wireshark to
+// dissect it. The synthesized connections are ended once idle, see
+// WithIdleTimeout, or when the Capture is closed.
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// flow is a synthesized TCP connection.
+type flow struct {
+	client, server       netip.AddrPort
+	clientSeq, serverSeq uint32
+	lastExchange         time.Time
+	// streaming is the number of response bodies being written to the flow
+	streaming int
+}
+
+type flowKey struct {
+	clientAddr string
+	host       string
+}
+
+// exchange is a request waiting for its response.
+type exchange struct {
+	time    time.Time
+	head    []byte
+	chunked bool
+
+	mtx    sync.Mutex
+	body   bytes.Buffer
+	server netip.AddrPort
+}
+
+// request returns the request of e as sent, with the part of its body read
+// by the proxy so far.
+func (e *exchange) request() []byte {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	data := bytes.Clone(e.head)
+	if !e.chunked {
+		return append(data, e.body.Bytes()...)
+	}
+	if e.body.Len() > 0 {
+		data = append(data, chunk(e.body.Bytes())...)
+	}
+	return append(data, lastChunk(nil)...)
+}
+
+// requestBody captures the body of a request while it is sent.
+type requestBody struct {
+	io.ReadCloser
+	e *exchange
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.e.mtx.Lock()
+	b.e.body.Write(p[:n])
+	b.e.mtx.Unlock()
+	return n, err
+}
+
+// Capture writes the HTTP exchanges going through the proxy to a pcapng stream.
+type Capture struct {
+	idleTimeout time.Duration
+	stop        chan struct{}
+
+	mtx     sync.Mutex
+	w       *Writer
+	flows   map[flowKey]*flow
+	closed  bool
+	pending sync.Map // *goproxy.ProxyCtx -> *exchange
+}
+
+// Option is a function type for configuring the Capture.
+type Option func(*Capture)
+
+// WithIdleTimeout sets how long a synthesized TCP connection stays open
+// without exchanges before it is ended. The next exchanges of the client
+// connection, if any, are written as a new TCP connection. Defaults to 2m.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Capture) {
+		c.idleTimeout = d
+	}
+}
+
+// New creates a Capture writing to w.
+func New(w io.Writer, opts ...Option) (*Capture, error) {
+	pw, err := NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{
+		idleTimeout: 2 * time.Minute,
+		stop:        make(chan struct{}),
+		w:           pw,
+		flows:       make(map[flowKey]*flow),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	go c.endIdleFlows()
+	return c, nil
+}
+
+// endIdleFlows ends the flows without exchanges for the idle timeout, until
+// the Capture is closed.
+func (c *Capture) endIdleFlows() {
+	ticker := time.NewTicker(max(c.idleTimeout/2, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.mtx.Lock()
+			for key, f := range c.flows {
+				if f.streaming == 0 && now.Sub(f.lastExchange) >= c.idleTimeout {
+					_ = c.end(f, now)
+					delete(c.flows, key)
+				}
+			}
+			c.mtx.Unlock()
+		}
+	}
+}
+
+// OnRequest records req, capturing its body while it is sent, and traces
+// the address of the server it is sent to.
+func (c *Capture) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	// Dump the head of the request as sent to the destination server, in
+	// origin form
+	out := *req
+	out.RequestURI = ""
+	head, err := httputil.DumpRequest(&out, false)
+	if err != nil {
+		ctx.Warnf("pcap: cannot dump %v %v: %v", req.Method, req.URL, err)
+		return req, nil
+	}
+
+	e := &exchange{time: time.Now(), head: head, chunked: isChunked(req.TransferEncoding)}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &requestBody{ReadCloser: req.Body, e: e}
+	}
+	c.pending.Store(ctx, e)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				e.mtx.Lock()
+				e.server = addr.AddrPort()
+				e.mtx.Unlock()
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), nil
+}
+
+// OnResponse writes the request and the head of its response to the
+// capture. The response body is written while it is sent to the client.
+func (c *Capture) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, ok := c.pending.LoadAndDelete(ctx)
+	if !ok || resp == nil {
+		return resp
+	}
+	e := v.(*exchange) //nolint:forcetypeassert
+
+	head, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		ctx.Warnf("pcap: cannot dump response of %v: %v", ctx.Req.URL, err)
+		return resp
+	}
+
+	e.mtx.Lock()
+	server := e.server
+	e.mtx.Unlock()
+	if !server.IsValid() {
+		// The request was answered by the proxy, use the destination
+		// address when it is an IP, or the unspecified address otherwise
+		server = destination(ctx.Req)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return resp
+	}
+	f := c.flow(ctx.Req, server, e.time)
+	if f == nil {
+		return resp
+	}
+	if err := c.send(f, true, e.time, e.request()); err != nil {
+		ctx.Warnf("pcap: cannot write request: %v", err)
+	}
+	f.lastExchange = time.Now()
+	if err := c.send(f, false, f.lastExchange, head); err != nil {
+		ctx.Warnf("pcap: cannot write response: %v", err)
+	}
+	// The body of a protocol switch is the connection itself
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp
+	}
+	f.streaming++
+	resp.Body = &responseBody{ReadCloser: resp.Body, c: c, f: f, ctx: ctx, resp: resp}
+	return resp
+}
+
+// responseBody writes the body of a response to its flow while it is sent
+// to the client.
+type responseBody struct {
+	io.ReadCloser
+	c    *Capture
+	f    *flow
+	ctx  *goproxy.ProxyCtx
+	resp *http.Response
+	once sync.Once
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		data := p[:n]
+		if isChunked(b.resp.TransferEncoding) {
+			data = chunk(data)
+		}
+		b.write(data)
+	}
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+// finish ends the body once, when it has been read completely or closed.
+func (b *responseBody) finish() {
+	b.once.Do(func() {
+		if isChunked(b.resp.TransferEncoding) {
+			b.write(lastChunk(b.resp.Trailer))
+		}
+		b.c.mtx.Lock()
+		b.f.streaming--
+		b.c.mtx.Unlock()
+	})
+}
+
+func (b *responseBody) write(data []byte) {
+	b.c.mtx.Lock()
+	defer b.c.mtx.Unlock()
+	if b.c.closed {
+		return
+	}
+	b.f.lastExchange = time.Now()
+	if err := b.c.send(b.f, false, b.f.lastExchange, data); err != nil {
+		b.ctx.Warnf("pcap: cannot write response: %v", err)
+	}
+}
+
+func isChunked(transferEncoding []string) bool {
+	return len(transferEncoding) > 0 && transferEncoding[0] == "chunked"
+}
+
+// chunk returns data in the chunked transfer coding.
+func chunk(data []byte) []byte {
+	out := append(strconv.AppendInt(nil, int64(len(data)), 16), "\r\n"...)
+	out = append(out, data...)
+	return append(out, "\r\n"...)
+}
+
+// lastChunk returns the end of a body in the chunked transfer coding.
+func lastChunk(trailer http.Header) []byte {
+	var out bytes.Buffer
+	out.WriteString("0\r\n")
+	_ = trailer.Write(&out)
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+func destination(req *http.Request) netip.AddrPort {
+	port := uint16(80)
+	if req.URL.Scheme == "https" {
+		port = 443
+	}
+	if p, err := strconv.ParseUint(req.URL.Port(), 10, 16); err == nil {
+		port = uint16(p)
+	}
+	addr, err := netip.ParseAddr(req.URL.Hostname())
+	if err != nil {
+		addr = netip.IPv4Unspecified()
+	}
+	return netip.AddrPortFrom(addr, port)
+}
+
+// sameFamily converts the addresses to IPv6 when one of them is.
+func sameFamily(client, server netip.AddrPort) (netip.AddrPort, netip.AddrPort) {
+	client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	server = netip.AddrPortFrom(server.Addr().Unmap(), server.Port())
+	if client.Addr().Is4() == server.Addr().Is4() {
+		return client, server
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16(client.Addr().As16()), client.Port()),
+		netip.AddrPortFrom(netip.AddrFrom16(server.Addr().As16()), server.Port())
+}
+
+// flow returns the flow of the client connection of req with its
+// destination, writing its handshake at t when it is new.
+func (c *Capture) flow(req *http.Request, server netip.AddrPort, t time.Time) *flow {
+	key := flowKey{clientAddr: req.RemoteAddr, host: req.URL.Host}
+	if f, ok := c.flows[key]; ok {
+		return f
+	}
+	client, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	client, server = sameFamily(client, server)
+	f := &flow{client: client, server: server, clientSeq: rand.Uint32(), serverSeq: rand.Uint32()}
+	c.flows[key] = f
+
+	// The SYN flags count as one byte in the sequence
+	_ = c.w.WritePacket(t, tcpPacket(f.client, f.server, f.clientSeq, 0, _tcpFlagSyn, nil))
+	f.clientSeq++
+	_ = c.w.WritePacket(t, tcpPacket(f.server, f.client, f.serverSeq, f.clientSeq, _tcpFlagSyn|_tcpFlagAck, nil))
+	f.serverSeq++
+	_ = c.w.WritePacket(t, tcpPacket(f.client, f.server, f.clientSeq, f.serverSeq, _tcpFlagAck, nil))
+	return f
+}
+
+// send writes data sent by the client, or the server, in segments.
+func (c *Capture) send(f *flow, fromClient bool, t time.Time, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), _maxSegmentSize)
+		var packet []byte
+		if fromClient {
+			packet = tcpPacket(f.client, f.server, f.clientSeq, f.serverSeq, _tcpFlagAck|_tcpFlagPsh, data[:n])
+			f.clientSeq += uint32(n)
+		} else {
+			packet = tcpPacket(f.server, f.client, f.serverSeq, f.clientSeq, _tcpFlagAck|_tcpFlagPsh, data[:n])
+			f.serverSeq += uint32(n)
+		}
+		if err := c.w.WritePacket(t, packet); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// end writes the teardown of f at t.
+func (c *Capture) end(f *flow, t time.Time) error {
+	packets := [][]byte{
+		tcpPacket(f.client, f.server, f.clientSeq, f.serverSeq, _tcpFlagFin|_tcpFlagAck, nil),
+		tcpPacket(f.server, f.client, f.serverSeq, f.clientSeq+1, _tcpFlagFin|_tcpFlagAck, nil),
+		tcpPacket(f.client, f.server, f.clientSeq+1, f.serverSeq+1, _tcpFlagAck, nil),
+	}
+	for _, packet := range packets {
+		if err := c.w.WritePacket(t, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends the synthesized TCP connections. The exchanges completed
+// afterwards are not written anymore.
+func (c *Capture) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.closed {
+		close(c.stop)
+	}
+	now := time.Now()
+	var firstErr error
+	for key, f := range c.flows {
+		if err := c.end(f, now); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.flows, key)
+	}
+	c.closed = true
+	return firstErr
+}
@@ -0,0 +1,306 @@
+package pcap_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/elazarl/goproxy/ext/pcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type segment struct {
+	src, dst netip.AddrPort
+	seq, ack uint32
+	flags    byte
+	payload  []byte
+}
+
+// onesSum returns the folded ones' complement sum of data.
+func onesSum(data []byte, initial uint32) uint16 {
+	s := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s > 0xFFFF {
+		s = (s >> 16) + (s & 0xFFFF)
+	}
+	return uint16(s)
+}
+
+// parseCapture returns the TCP segments of a pcapng stream of raw IPv4
+// packets, checking the blocks and checksums along the way.
+func parseCapture(t *testing.T, data []byte) []segment {
+	t.Helper()
+	var segments []segment
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+		blockType := binary.LittleEndian.Uint32(data)
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		require.Zero(t, length%4, "blocks are 32 bits aligned")
+		require.Equal(t, uint32(length), binary.LittleEndian.Uint32(data[length-4:]))
+		block := data[:length]
+		data = data[length:]
+
+		switch blockType {
+		case 0x0A0D0D0A:
+			assert.Equal(t, uint32(0x1A2B3C4D), binary.LittleEndian.Uint32(block[8:]))
+		case 1:
+			assert.Equal(t, uint16(101), binary.LittleEndian.Uint16(block[8:]), "raw IP link type")
+		case 6:
+			packet := block[28 : 28+binary.LittleEndian.Uint32(block[20:])]
+			require.Equal(t, byte(0x45), packet[0], "IPv4 packet")
+			require.Equal(t, uint16(0xFFFF), onesSum(packet[:20], 0), "IPv4 header checksum")
+			tcp := packet[20:]
+			pseudo := make([]byte, 12)
+			copy(pseudo, packet[12:20])
+			pseudo[9] = 6
+			binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+			require.Equal(t, uint16(0xFFFF), onesSum(tcp, uint32(onesSum(pseudo, 0))), "TCP checksum")
+
+			src, _ := netip.AddrFromSlice(packet[12:16])
+			dst, _ := netip.AddrFromSlice(packet[16:20])
+			segments = append(segments, segment{
+				src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:])),
+				dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:])),
+				seq:     binary.BigEndian.Uint32(tcp[4:]),
+				ack:     binary.BigEndian.Uint32(tcp[8:]),
+				flags:   tcp[13],
+				payload: tcp[20:],
+			})
+		default:
+			t.Fatalf("Unexpected block type %x", blockType)
+		}
+	}
+	return segments
+}
+
+// streams reassembles the payloads sent by each endpoint of each connection,
+// checking that sequence numbers follow each other.
+func streams(t *testing.T, segments []segment) map[string]string {
+	t.Helper()
+	next := make(map[string]uint32)
+	data := make(map[string]string)
+	for _, s := range segments {
+		key := s.src.String() + ">" + s.dst.String()
+		if s.flags&0x02 != 0 {
+			next[key] = s.seq + 1
+			continue
+		}
+		if len(s.payload) > 0 {
+			require.Equal(t, next[key], s.seq, "sequence of %s", key)
+			next[key] += uint32(len(s.payload))
+			data[key] += string(s.payload)
+		}
+	}
+	return data
+}
+
+func TestCapture(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.URL.Path, strings.Repeat("x", 3000)+string(body))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	var out bytes.Buffer
+	capture, err := pcap.New(&out)
+	require.NoError(t, err)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(capture.OnRequest)
+	proxy.OnResponse().DoFunc(capture.OnResponse)
+	client := proxytest.NewClient(t, proxy)
+
+	for _, u := range []string{plain.URL + "/a", plain.URL + "/b", secure.URL + "/c", secure.URL + "/d"} {
+		resp, err := client.Post(u, "text/plain", strings.NewReader("body of "+u))
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	require.NoError(t, capture.Close())
+
+	segments := parseCapture(t, out.Bytes())
+	var syns, fins int
+	for _, s := range segments {
+		if s.flags == 0x02 {
+			syns++
+		}
+		if s.flags&0x01 != 0 {
+			fins++
+		}
+	}
+	assert.Equal(t, 2, syns, "one connection per client connection and destination")
+	assert.Equal(t, 4, fins)
+
+	plainAddr := netip.MustParseAddrPort(strings.TrimPrefix(plain.URL, "http://"))
+	secureAddr := netip.MustParseAddrPort(strings.TrimPrefix(secure.URL, "https://"))
+	var toPlain, fromPlain, toSecure, fromSecure string
+	for key, data := range streams(t, segments) {
+		switch {
+		case strings.HasSuffix(key, ">"+plainAddr.String()):
+			toPlain = data
+		case strings.HasPrefix(key, plainAddr.String()+">"):
+			fromPlain = data
+		case strings.HasSuffix(key, ">"+secureAddr.String()):
+			toSecure = data
+		case strings.HasPrefix(key, secureAddr.String()+">"):
+			fromSecure = data
+		}
+	}
+
+	assert.Contains(t, toPlain, "POST /a HTTP/1.1\r\n")
+	assert.Contains(t, toPlain, "body of "+plain.URL+"/b")
+	assert.Contains(t, fromPlain, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, responseBodies(t, fromPlain), "/b "+strings.Repeat("x", 3000)+"body of "+plain.URL+"/b")
+	// MITM'd content is decrypted
+	assert.Contains(t, toSecure, "POST /c HTTP/1.1\r\n")
+	assert.Contains(t, toSecure, "POST /d HTTP/1.1\r\n")
+	assert.Contains(t, responseBodies(t, fromSecure), "/d "+strings.Repeat("x", 3000)+"body of "+secure.URL+"/d")
+}
+
+// responseBodies parses the responses sent by a server in a capture.
+func responseBodies(t *testing.T, data string) []string {
+	t.Helper()
+	var bodies []string
+	r := bufio.NewReader(strings.NewReader(data))
+	for {
+		if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+			return bodies
+		}
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+	}
+}
+
+// lockedBuffer is written by the Capture while the test reads it.
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func TestCaptureEndsIdleFlows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	var out lockedBuffer
+	capture, err := pcap.New(&out, pcap.WithIdleTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(capture.OnRequest)
+	proxy.OnResponse().DoFunc(capture.OnResponse)
+	client := proxytest.NewClient(t, proxy)
+
+	count := func() (syns, fins int) {
+		for _, s := range parseCapture(t, out.Bytes()) {
+			if s.flags == 0x02 {
+				syns++
+			}
+			if s.flags&0x01 != 0 {
+				fins++
+			}
+		}
+		return syns, fins
+	}
+	get := func(path string) {
+		proxytest.Do(t, client, http.MethodGet, server.URL+path, "", nil)
+	}
+
+	get("/a")
+	// The flow is ended while the client connection is still open
+	require.Eventually(t, func() bool {
+		_, fins := count()
+		return fins == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	get("/b")
+	require.NoError(t, capture.Close())
+
+	syns, fins := count()
+	assert.Equal(t, 2, syns, "the next exchange starts a new connection")
+	assert.Equal(t, 4, fins)
+}
+
+func TestCaptureStreamsResponses(t *testing.T) {
+	// The server ends the body once the client got its beginning, which it
+	// can't if the capture reads the whole body before forwarding it. The
+	// proxy flushes the events streams as it forwards them.
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+			_, _ = io.WriteString(w, " second")
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	capture, err := pcap.New(&out)
+	require.NoError(t, err)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(capture.OnRequest)
+	proxy.OnResponse().DoFunc(capture.OnResponse)
+	client := proxytest.NewClient(t, proxy)
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(resp.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(first))
+	close(received)
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, " second", string(rest))
+	require.NoError(t, capture.Close())
+
+	serverAddr := strings.TrimPrefix(server.URL, "http://")
+	var fromServer string
+	for key, data := range streams(t, parseCapture(t, out.Bytes())) {
+		if strings.HasPrefix(key, serverAddr+">") {
+			fromServer = data
+		}
+	}
+	assert.Equal(t, []string{"first second"}, responseBodies(t, fromServer))
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+)
+
+const (
+	_blockSectionHeader  = 0x0A0D0D0A
+	_blockInterface      = 0x00000001
+	_blockEnhancedPacket = 0x00000006
+	_byteOrderMagic      = 0x1A2B3C4D
+	_linkTypeRaw         = 101
+	_tcpHeaderLen        = 20
+	_ipv4HeaderLen       = 20
+	_ipv6HeaderLen       = 40
+	_maxSegmentSize      = 1460
+	_protocolTCP         = 6
+	_tcpFlagFin          = 0x01
+	_tcpFlagSyn          = 0x02
+	_tcpFlagPsh          = 0x08
+	_tcpFlagAck          = 0x10
+)
+
+// Writer writes raw IP packets to a pcapng stream, with a single interface.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the pcapng section header and interface description to
+// w, and returns a Writer adding packets after them.
+func NewWriter(w io.Writer) (*Writer, error) {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], _blockSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], _byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[14:], 0) // minor version
+	// Unknown section length
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	// Timestamps have the default resolution of microseconds, and packets
+	// are not truncated
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], _blockInterface)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], _linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0) // snap length
+	binary.LittleEndian.PutUint32(idb[16:], uint32(len(idb)))
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes an IP packet captured at t.
+func (w *Writer) WritePacket(t time.Time, packet []byte) error {
+	padded := (len(packet) + 3) &^ 3
+	block := make([]byte, 32+padded)
+	ts := uint64(t.UnixMicro())
+	binary.LittleEndian.PutUint32(block[0:], _blockEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(block)))
+	binary.LittleEndian.PutUint32(block[8:], 0) // interface id
+	binary.LittleEndian.PutUint32(block[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+	copy(block[28:], packet)
+	binary.LittleEndian.PutUint32(block[28+padded:], uint32(len(block)))
+	_, err := w.w.Write(block)
+	return err
+}
+
+// tcpPacket returns an IP packet holding a TCP segment from src to dst.
+// Both addresses must be of the same family.
+func tcpPacket(src, dst netip.AddrPort, seq, ack uint32, flags byte, payload []byte) []byte {
+	tcpLen := _tcpHeaderLen + len(payload)
+	var packet, pseudo []byte
+	if src.Addr().Is4() {
+		packet = make([]byte, _ipv4HeaderLen+tcpLen)
+		ip := packet[:_ipv4HeaderLen]
+		ip[0] = 0x45 // version 4, header of 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64                                 // TTL
+		ip[9] = _protocolTCP
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:], s[:])
+		copy(ip[16:], d[:])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], s[:])
+		copy(pseudo[4:], d[:])
+		pseudo[9] = _protocolTCP
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(tcpLen))
+	} else {
+		packet = make([]byte, _ipv6HeaderLen+tcpLen)
+		ip := packet[:_ipv6HeaderLen]
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(tcpLen))
+		ip[6] = _protocolTCP
+		ip[7] = 64 // hop limit
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], s[:])
+		copy(ip[24:], d[:])
+
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], s[:])
+		copy(pseudo[16:], d[:])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(tcpLen))
+		pseudo[39] = _protocolTCP
+	}
+
+	tcp := packet[len(packet)-tcpLen:]
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = (_tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF) // window
+	copy(tcp[_tcpHeaderLen:], payload)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	return packet
+}
+
+// sum returns the ones' complement sum of data, as 16 bits big endian words.
+func sum(data []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of data, with the sum of a pseudo
+// header.
+func checksum(data []byte, initial uint32) uint16 {
+	s := initial + sum(data)
+	for s > 0xFFFF {
+		s = (s >> 16) + (s & 0xFFFF)
+	}
+	return ^uint16(s)
+}
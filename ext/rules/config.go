@@ -0,0 +1,240 @@
+package rules
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+// Config is the JSON configuration of the proxy policy.
+//
+//	{
+//	  "auth": {"realm": "corp", "users": {"alice": "s3cret"}},
+//	  "connect": [
+//	    {"match": {"hosts": ["api.example:443"]}, "action": "mitm"},
+//	    {"match": {"host_regexps": ["\\.internal:"]}, "action": "reject"}
+//	  ],
+//	  "requests": [
+//	    {"match": {"url_regexp": "^ads\\."}, "block": {"status": 403, "body": "blocked"}},
+//	    {"match": {"hosts": ["old.example"]}, "redirect": "https://new.example/"},
+//	    {"match": {"src_ips": ["10.0.0.1"]}, "set_headers": {"X-Team": "qa"}, "remove_headers": ["Cookie"]}
+//	  ],
+//	  "responses": [
+//	    {"match": {"content_types": ["text/html"]}, "set_headers": {"Cache-Control": "no-store"}}
+//	  ]
+//	}
+type Config struct {
+	// Auth requires clients to authenticate with HTTP basic authentication
+	Auth *Auth `json:"auth,omitempty"`
+	// Connect chooses how CONNECT requests are handled, by the first matching
+	// rule. CONNECT requests matching no rule are accepted.
+	Connect []ConnectRule `json:"connect,omitempty"`
+	// Requests are applied in order to the requests they match, until one
+	// of them answers the request.
+	Requests []RequestRule `json:"requests,omitempty"`
+	// Responses are applied in order to the responses they match.
+	Responses []ResponseRule `json:"responses,omitempty"`
+}
+
+// Auth configures HTTP basic authentication.
+type Auth struct {
+	Realm string `json:"realm"`
+	// Users maps user names to their password
+	Users map[string]string `json:"users"`
+}
+
+// Match selects the requests a rule applies to. All of its non-empty fields
+// must match, each of them matching when one of its values does.
+type Match struct {
+	// Hosts are matched like goproxy.ReqHostIs, against the host and port
+	// of the request URL
+	Hosts []string `json:"hosts,omitempty"`
+	// HostRegexps are matched like goproxy.ReqHostMatches
+	HostRegexps []string `json:"host_regexps,omitempty"`
+	// URLRegexp is matched like goproxy.UrlMatches
+	URLRegexp string `json:"url_regexp,omitempty"`
+	// SrcIPs are matched like goproxy.SrcIpIs
+	SrcIPs  []string `json:"src_ips,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	// ContentTypes are matched like goproxy.ContentTypeIs, in response rules only
+	ContentTypes []string `json:"content_types,omitempty"`
+	// StatusCodes are matched like goproxy.StatusCodeIs, in response rules only
+	StatusCodes []int `json:"status_codes,omitempty"`
+}
+
+// ConnectRule chooses the action for the matching CONNECT requests:
+// "accept", "mitm" or "reject".
+type ConnectRule struct {
+	Match  Match  `json:"match"`
+	Action string `json:"action"`
+}
+
+// RequestRule rewrites the headers of the matching requests, or answers them
+// with a block or a redirection.
+type RequestRule struct {
+	Match         Match             `json:"match"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Block         *Block            `json:"block,omitempty"`
+	// Redirect answers with a 302 Found redirection to this URL
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// ResponseRule rewrites the headers of the matching responses, or replaces
+// them with a block.
+type ResponseRule struct {
+	Match         Match             `json:"match"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Block         *Block            `json:"block,omitempty"`
+}
+
+// Block is a response replacing the one of the destination server.
+type Block struct {
+	// Status defaults to 403
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+// LoadFile reads a Config from a JSON file.
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid rules in %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// policy is a compiled Config.
+type policy struct {
+	authReq     goproxy.ReqHandler
+	authConnect goproxy.HttpsHandler
+	connect     []compiledConnect
+	requests    []compiledRequest
+	responses   []compiledResponse
+}
+
+type compiledConnect struct {
+	conds  []goproxy.ReqCondition
+	action *goproxy.ConnectAction
+}
+
+type compiledRequest struct {
+	conds []goproxy.ReqCondition
+	rule  RequestRule
+}
+
+type compiledResponse struct {
+	conds     []goproxy.ReqCondition
+	respConds []goproxy.RespCondition
+	rule      ResponseRule
+}
+
+var connectActions = map[string]*goproxy.ConnectAction{
+	"accept": goproxy.OkConnect,
+	"mitm":   goproxy.MitmConnect,
+	"reject": goproxy.RejectConnect,
+}
+
+func compile(cfg *Config) (*policy, error) {
+	p := &policy{}
+	if cfg.Auth != nil {
+		users := cfg.Auth.Users
+		check := func(user, passwd string) bool {
+			expected, ok := users[user]
+			return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(passwd)) == 1
+		}
+		p.authReq = auth.Basic(cfg.Auth.Realm, check)
+		p.authConnect = auth.BasicConnect(cfg.Auth.Realm, check)
+	}
+	for n, rule := range cfg.Connect {
+		conds, err := compileMatch(rule.Match, false)
+		if err != nil {
+			return nil, fmt.Errorf("connect rule %d: %w", n, err)
+		}
+		action, ok := connectActions[rule.Action]
+		if !ok {
+			return nil, fmt.Errorf("connect rule %d: unknown action %q", n, rule.Action)
+		}
+		p.connect = append(p.connect, compiledConnect{conds: conds, action: action})
+	}
+	for n, rule := range cfg.Requests {
+		conds, err := compileMatch(rule.Match, false)
+		if err != nil {
+			return nil, fmt.Errorf("request rule %d: %w", n, err)
+		}
+		if rule.Block != nil && rule.Redirect != "" {
+			return nil, fmt.Errorf("request rule %d: both block and redirect are set", n)
+		}
+		p.requests = append(p.requests, compiledRequest{conds: conds, rule: rule})
+	}
+	for n, rule := range cfg.Responses {
+		conds, err := compileMatch(rule.Match, true)
+		if err != nil {
+			return nil, fmt.Errorf("response rule %d: %w", n, err)
+		}
+		var respConds []goproxy.RespCondition
+		if len(rule.Match.ContentTypes) > 0 {
+			respConds = append(respConds, goproxy.ContentTypeIs(rule.Match.ContentTypes[0], rule.Match.ContentTypes[1:]...))
+		}
+		if len(rule.Match.StatusCodes) > 0 {
+			respConds = append(respConds, goproxy.StatusCodeIs(rule.Match.StatusCodes...))
+		}
+		p.responses = append(p.responses, compiledResponse{conds: conds, respConds: respConds, rule: rule})
+	}
+	return p, nil
+}
+
+// compileMatch returns the request conditions of m.
+func compileMatch(m Match, response bool) ([]goproxy.ReqCondition, error) {
+	if !response && (len(m.ContentTypes) > 0 || len(m.StatusCodes) > 0) {
+		return nil, errors.New("content_types and status_codes only apply to responses")
+	}
+	var conds []goproxy.ReqCondition
+	if len(m.Hosts) > 0 {
+		conds = append(conds, goproxy.ReqHostIs(m.Hosts...))
+	}
+	if len(m.HostRegexps) > 0 {
+		regexps := make([]*regexp.Regexp, 0, len(m.HostRegexps))
+		for _, expr := range m.HostRegexps {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			regexps = append(regexps, re)
+		}
+		conds = append(conds, goproxy.ReqHostMatches(regexps...))
+	}
+	if m.URLRegexp != "" {
+		re, err := regexp.Compile(m.URLRegexp)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, goproxy.UrlMatches(re))
+	}
+	if len(m.SrcIPs) > 0 {
+		conds = append(conds, goproxy.SrcIpIs(m.SrcIPs...))
+	}
+	if len(m.Methods) > 0 {
+		methods := m.Methods
+		conds = append(conds, goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+			return slices.ContainsFunc(methods, func(method string) bool {
+				return strings.EqualFold(method, req.Method)
+			})
+		}))
+	}
+	return conds, nil
+}
@@ -0,0 +1,235 @@
+// Package rules configures the policy of a goproxy proxy from a JSON file,
+// using the building blocks of the library: host, URL and source IP
+// conditions, MITM and reject actions, header rewrites, blocks, redirections
+// and basic authentication.
+//
+// The policy can be reloaded at any time, for example when the file changes
+// or on SIGHUP. Reloading atomically swaps the rules used by new requests,
+// without affecting the connections being served.
+//
+//	cfg, err := rules.LoadFile("/etc/proxy/rules.json")
+//	...
+//	r, err := rules.New(cfg)
+//	...
+//	r.Register(proxy)
+//	go r.Watch(ctx, "/etc/proxy/rules.json", 5*time.Second)
+//	go r.ReloadOnSignal(ctx, "/etc/proxy/rules.json")
+package rules
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Rules applies the policy of its current Config.
+type Rules struct {
+	current atomic.Pointer[policy]
+	logger  goproxy.Logger
+}
+
+// New creates Rules applying cfg.
+func New(cfg *Config) (*Rules, error) {
+	p, err := compile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rules{logger: log.New(os.Stderr, "", log.LstdFlags)}
+	r.current.Store(p)
+	return r, nil
+}
+
+// Register adds the handlers of the rules to proxy. Reload errors are then
+// reported to the logger of proxy.
+func (r *Rules) Register(proxy *goproxy.ProxyHttpServer) {
+	r.logger = proxy.Logger
+	proxy.OnRequest().HandleConnect(r)
+	proxy.OnRequest().DoFunc(r.OnRequest)
+	proxy.OnResponse().DoFunc(r.OnResponse)
+}
+
+// Reload replaces the current policy with cfg. When cfg is invalid, the
+// current policy is kept.
+func (r *Rules) Reload(cfg *Config) error {
+	p, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+	r.current.Store(p)
+	return nil
+}
+
+// ReloadFile replaces the current policy with the one of the file at path.
+func (r *Rules) ReloadFile(path string) error {
+	cfg, err := LoadFile(path)
+	if err != nil {
+		return err
+	}
+	return r.Reload(cfg)
+}
+
+func (r *Rules) reloadFile(path, reason string) {
+	if err := r.ReloadFile(path); err != nil {
+		r.logger.Printf("WARN: Cannot reload rules from %s on %s, keeping the current ones: %v", path, reason, err)
+		return
+	}
+	r.logger.Printf("INFO: Reloaded rules from %s on %s", path, reason)
+}
+
+// Watch reloads the rules from the file at path whenever it changes, checking
+// it every interval, until ctx is done.
+func (r *Rules) Watch(ctx context.Context, path string, interval time.Duration) {
+	var modTime time.Time
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil || (fi.ModTime().Equal(modTime) && fi.Size() == size) {
+			continue
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+		r.reloadFile(path, "file change")
+	}
+}
+
+// ReloadOnSignal reloads the rules from the file at path whenever the process
+// receives one of the given signals, SIGHUP by default, until ctx is done.
+func (r *Rules) ReloadOnSignal(ctx context.Context, path string, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			r.reloadFile(path, sig.String())
+		}
+	}
+}
+
+func matchReq(conds []goproxy.ReqCondition, req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	for _, cond := range conds {
+		if !cond.HandleReq(req, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func rewriteHeaders(header http.Header, set map[string]string, remove []string) {
+	for _, name := range remove {
+		header.Del(name)
+	}
+	for name, value := range set {
+		header.Set(name, value)
+	}
+}
+
+func (b *Block) response(req *http.Request) *http.Response {
+	status := b.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, status, b.Body)
+}
+
+// HandleConnect implements goproxy.HttpsHandler.
+func (r *Rules) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	p := r.current.Load()
+	if p.authConnect != nil {
+		if action, host := p.authConnect.HandleConnect(host, ctx); action != nil {
+			return action, host
+		}
+	}
+	for _, rule := range p.connect {
+		if matchReq(rule.conds, ctx.Req, ctx) {
+			return rule.action, host
+		}
+	}
+	return nil, host
+}
+
+// OnRequest applies the request rules.
+func (r *Rules) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	p := r.current.Load()
+	if p.authReq != nil {
+		// The requests of MITM'd connections are authenticated with the
+		// credentials of their CONNECT, which may have been MITM'd by another
+		// handler than the rules
+		if ctx.ConnectReq != nil && req.Header.Get("Proxy-Authorization") == "" {
+			if credentials := ctx.ConnectReq.Header.Get("Proxy-Authorization"); credentials != "" {
+				req.Header.Set("Proxy-Authorization", credentials)
+			}
+		}
+		var resp *http.Response
+		if req, resp = p.authReq.Handle(req, ctx); resp != nil {
+			return req, resp
+		}
+	}
+	for _, rule := range p.requests {
+		if !matchReq(rule.conds, req, ctx) {
+			continue
+		}
+		rewriteHeaders(req.Header, rule.rule.SetHeaders, rule.rule.RemoveHeaders)
+		if rule.rule.Block != nil {
+			ctx.Logf("Blocked %v by rules", req.URL)
+			return req, rule.rule.Block.response(req)
+		}
+		if rule.rule.Redirect != "" {
+			ctx.Logf("Redirected %v to %v by rules", req.URL, rule.rule.Redirect)
+			resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusFound, "")
+			resp.Header.Set("Location", rule.rule.Redirect)
+			return req, resp
+		}
+	}
+	return req, nil
+}
+
+// OnResponse applies the response rules.
+func (r *Rules) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	p := r.current.Load()
+	for _, rule := range p.responses {
+		if !matchReq(rule.conds, ctx.Req, ctx) || !matchResp(rule.respConds, resp, ctx) {
+			continue
+		}
+		rewriteHeaders(resp.Header, rule.rule.SetHeaders, rule.rule.RemoveHeaders)
+		if rule.rule.Block != nil {
+			ctx.Logf("Blocked response of %v by rules", ctx.Req.URL)
+			_ = resp.Body.Close()
+			return rule.rule.Block.response(ctx.Req)
+		}
+	}
+	return resp
+}
+
+func matchResp(conds []goproxy.RespCondition, resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	for _, cond := range conds {
+		if !cond.HandleResp(resp, ctx) {
+			return false
+		}
+	}
+	return true
+}
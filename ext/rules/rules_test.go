@@ -0,0 +1,213 @@
+package rules_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRulesProxy(t *testing.T, cfg string) (*rules.Rules, string, *httptest.Server) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(cfg), 0o600))
+	c, err := rules.LoadFile(path)
+	require.NoError(t, err)
+	r, err := rules.New(c)
+	require.NoError(t, err)
+
+	proxy := goproxy.NewProxyHttpServer()
+	r.Register(proxy)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	return r, path, s
+}
+
+func get(t *testing.T, proxyURL, target string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	u, _ := url.Parse(proxyURL)
+	client := &http.Client{
+		Transport:     &http.Transport{Proxy: http.ProxyURL(u)},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func connect(t *testing.T, proxyURL, host string) int {
+	t.Helper()
+	u, _ := url.Parse(proxyURL)
+	conn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		// The connection was closed without a response
+		return 0
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRules(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Server", "origin")
+		_, _ = io.WriteString(w, "team="+r.Header.Get("X-Team")+" cookie="+r.Header.Get("Cookie"))
+	}))
+	defer background.Close()
+	host := background.Listener.Addr().String()
+
+	_, _, s := newRulesProxy(t, `{
+	  "connect": [{"match": {"hosts": ["blocked.example:443"]}, "action": "reject"}],
+	  "requests": [
+	    {"match": {"url_regexp": "/ads/"}, "block": {"status": 451, "body": "no ads"}},
+	    {"match": {"url_regexp": "/old$", "methods": ["get"]}, "redirect": "http://new.example/"},
+	    {"match": {"src_ips": ["127.0.0.1"]}, "set_headers": {"X-Team": "qa"}, "remove_headers": ["Cookie"]}
+	  ],
+	  "responses": [
+	    {"match": {"hosts": ["`+host+`"], "content_types": ["text/html"]}, "set_headers": {"Cache-Control": "no-store"}, "remove_headers": ["Server"]}
+	  ]
+	}`)
+
+	resp, body := get(t, s.URL, background.URL+"/ads/banner", nil)
+	assert.Equal(t, 451, resp.StatusCode)
+	assert.Equal(t, "no ads", body)
+
+	resp, _ = get(t, s.URL, background.URL+"/old", nil)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://new.example/", resp.Header.Get("Location"))
+
+	resp, body = get(t, s.URL, background.URL+"/page", http.Header{"Cookie": {"session=1"}})
+	assert.Equal(t, "team=qa cookie=", body)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Empty(t, resp.Header.Get("Server"))
+
+	assert.Equal(t, 0, connect(t, s.URL, "blocked.example:443"))
+	assert.Equal(t, http.StatusOK, connect(t, s.URL, host))
+}
+
+func TestAuth(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+
+	_, _, s := newRulesProxy(t, `{"auth": {"realm": "test", "users": {"alice": "s3cret"}}}`)
+	resp, _ := get(t, s.URL, background.URL, nil)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, http.StatusProxyAuthRequired, connect(t, s.URL, "example.com:443"))
+
+	u, _ := url.Parse(s.URL)
+	u.User = url.UserPassword("alice", "s3cret")
+	_, body := get(t, u.String(), background.URL, nil)
+	assert.Equal(t, "ok", body)
+}
+
+func TestAuthWithMitm(t *testing.T) {
+	background := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+
+	r, _, s := newRulesProxy(t, `{
+	  "auth": {"realm": "test", "users": {"alice": "s3cret"}},
+	  "connect": [{"match": {"hosts": ["`+background.Listener.Addr().String()+`"]}, "action": "mitm"}]
+	}`)
+	u, _ := url.Parse(s.URL)
+	client := func(user *url.Userinfo) *http.Client {
+		proxyURL := *u
+		proxyURL.User = user
+		return &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+
+	// The CONNECT request is authenticated, not the MITM'd requests
+	resp, err := client(url.UserPassword("alice", "s3cret")).Get(background.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+
+	_, err = client(url.UserPassword("alice", "wrong")).Get(background.URL)
+	assert.Error(t, err)
+
+	// CONNECT requests MITM'd by a handler running before the rules aren't
+	// authenticated by them, their requests are
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	r.Register(proxy)
+	before := httptest.NewServer(proxy)
+	defer before.Close()
+	u, _ = url.Parse(before.URL)
+	for user, status := range map[*url.Userinfo]int{
+		nil:                                 http.StatusProxyAuthRequired,
+		url.UserPassword("alice", "wrong"):  http.StatusProxyAuthRequired,
+		url.UserPassword("alice", "s3cret"): http.StatusOK,
+	} {
+		resp, err := client(user).Get(background.URL)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, "user %v", user)
+	}
+}
+
+func TestReload(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+
+	r, path, s := newRulesProxy(t, `{"requests": [{"match": {"url_regexp": "/a$"}, "block": {}}]}`)
+	resp, _ := get(t, s.URL, background.URL+"/a", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, path, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"requests": [{"match": {"url_regexp": "/b$"}, "block": {}}]}`), 0o600))
+	assert.Eventually(t, func() bool {
+		// Keep changing the modification time, in case the watcher started after the write
+		now := time.Now()
+		require.NoError(t, os.Chtimes(path, now, now))
+		resp, _ := get(t, s.URL, background.URL+"/a", nil)
+		return resp.StatusCode == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond)
+	resp, _ = get(t, s.URL, background.URL+"/b", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Invalid rules are rejected, keeping the current ones
+	require.Error(t, r.Reload(&rules.Config{Connect: []rules.ConnectRule{{Action: "teleport"}}}))
+	require.Error(t, r.Reload(&rules.Config{Requests: []rules.RequestRule{{Match: rules.Match{ContentTypes: []string{"text/html"}}}}}))
+	resp, _ = get(t, s.URL, background.URL+"/b", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
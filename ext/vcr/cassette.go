@@ -0,0 +1,132 @@
+package vcr
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy/ext/internal/replay"
+)
+
+// Request is a recorded request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Interaction is a request recorded along with its response.
+type Interaction struct {
+	Request    Request   `json:"request"`
+	Response   Response  `json:"response"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// Cassette is a list of interactions, stored as a JSON file.
+type Cassette struct {
+	path    string
+	saveMtx sync.Mutex
+
+	mtx          sync.Mutex
+	interactions []*Interaction
+	replayed     []bool
+}
+
+type cassetteFile struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Load reads the cassette stored at path. A missing file is loaded as an
+// empty cassette, that will be created when saved.
+func Load(path string) (*Cassette, error) {
+	c := &Cassette{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file cassetteFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	c.interactions = file.Interactions
+	c.replayed = make([]bool, len(c.interactions))
+	return c, nil
+}
+
+// Interactions returns the interactions of the cassette.
+func (c *Cassette) Interactions() []*Interaction {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]*Interaction(nil), c.interactions...)
+}
+
+// Add appends an interaction to the cassette.
+func (c *Cassette) Add(i *Interaction) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.interactions = append(c.interactions, i)
+	c.replayed = append(c.replayed, false)
+}
+
+// find returns the first matching interaction that hasn't been replayed yet,
+// so that identical requests are answered in the recorded order, or the
+// last matching interaction once they all have been.
+func (c *Cassette) find(match func(i *Interaction) bool) *Interaction {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n := replay.Pick(c.replayed, func(n int) bool {
+		return match(c.interactions[n])
+	})
+	if n < 0 {
+		return nil
+	}
+	return c.interactions[n]
+}
+
+// Save writes the cassette to its file.
+func (c *Cassette) Save() error {
+	// Serialize saves, so that an older content can't overwrite a newer one
+	c.saveMtx.Lock()
+	defer c.saveMtx.Unlock()
+	c.mtx.Lock()
+	data, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that an interrupted test run
+	// doesn't leave a corrupted cassette behind
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
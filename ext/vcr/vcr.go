@@ -0,0 +1,258 @@
+// Package vcr records the traffic going through a goproxy proxy to a cassette
+// on disk, and replays it later, so that integration tests depending on
+// third-party APIs can run without network access.
+//
+//	cassette, err := vcr.Load("testdata/api.json")
+//	...
+//	recorder := vcr.New(cassette, vcr.Replay)
+//	defer recorder.Close()
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest().DoFunc(recorder.OnRequest)
+//	proxy.OnResponse().DoFunc(recorder.OnResponse)
+//
+// HTTPS traffic is recorded and replayed as long as it is MITM'd. The
+// credentials found in headers are redacted from the recorded interactions,
+// see WithRedactedHeaders.
+package vcr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/replay"
+	"github.com/elazarl/goproxy/ext/internal/urlutil"
+)
+
+// Mode selects whether a Recorder records or replays the traffic.
+type Mode int
+
+const (
+	// Record forwards the requests and adds them, along with their
+	// responses, to the cassette.
+	Record Mode = iota
+	// Replay answers the requests from the cassette.
+	Replay
+)
+
+// Matcher reports whether a request, with the given body, matches a recorded request.
+type Matcher func(req *http.Request, body []byte, recorded *Request) bool
+
+// MatchMethod matches requests with the same method.
+func MatchMethod(req *http.Request, body []byte, recorded *Request) bool {
+	return req.Method == recorded.Method
+}
+
+// MatchURL matches requests with the same URL, ignoring the default port of
+// its scheme and its fragment.
+func MatchURL(req *http.Request, body []byte, recorded *Request) bool {
+	u, err := url.Parse(recorded.URL)
+	return err == nil && urlutil.Normalize(req.URL) == urlutil.Normalize(u)
+}
+
+// MatchBody matches requests with the same body.
+func MatchBody(req *http.Request, body []byte, recorded *Request) bool {
+	return bytes.Equal(body, recorded.Body)
+}
+
+// MatchHeaders matches requests with the same values for the given headers.
+// Redacted values match the values they were computed from.
+func MatchHeaders(names ...string) Matcher {
+	return func(req *http.Request, body []byte, recorded *Request) bool {
+		for _, name := range names {
+			if !slices.EqualFunc(req.Header.Values(name), recorded.Header.Values(name), sameHeaderValue) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DefaultRedactedHeaders are the headers carrying credentials, redacted by
+// default from the recorded interactions.
+var DefaultRedactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+const redactedPrefix = "redacted:sha256:"
+
+// redact returns the value stored in cassettes in place of value.
+func redact(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return redactedPrefix + hex.EncodeToString(sum[:])
+}
+
+func sameHeaderValue(value, recorded string) bool {
+	if strings.HasPrefix(recorded, redactedPrefix) {
+		return redact(value) == recorded
+	}
+	return value == recorded
+}
+
+// redactHeaders returns a copy of header whose values for names are redacted.
+func redactHeaders(header http.Header, names []string) http.Header {
+	header = header.Clone()
+	for _, name := range names {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		redacted := make([]string, len(values))
+		for n, value := range values {
+			redacted[n] = redact(value)
+		}
+		header[http.CanonicalHeaderKey(name)] = redacted
+	}
+	return header
+}
+
+// MatchAll matches requests matched by all the matchers.
+func MatchAll(matchers ...Matcher) Matcher {
+	return func(req *http.Request, body []byte, recorded *Request) bool {
+		for _, m := range matchers {
+			if !m(req, body, recorded) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DefaultMatcher matches requests with the same method and URL.
+var DefaultMatcher = MatchAll(MatchMethod, MatchURL)
+
+// Recorder records requests to a Cassette, or replays them from it.
+type Recorder struct {
+	cassette    *Cassette
+	mode        Mode
+	matcher     Matcher
+	passthrough bool
+	redacted    []string
+
+	pending sync.Map // *goproxy.ProxyCtx -> *Interaction
+	misses  replay.Misses
+}
+
+// Option is a function type for configuring the Recorder.
+type Option func(*Recorder)
+
+// WithMatcher sets how requests are matched with the recorded ones when
+// replaying. Defaults to DefaultMatcher.
+func WithMatcher(matcher Matcher) Option {
+	return func(r *Recorder) {
+		r.matcher = matcher
+	}
+}
+
+// WithPassthrough forwards the requests that don't match any recorded
+// request when replaying, instead of failing them.
+func WithPassthrough() Option {
+	return func(r *Recorder) {
+		r.passthrough = true
+	}
+}
+
+// WithRedactedHeaders sets the request and response headers whose values are
+// replaced by their SHA-256 hash in the recorded interactions, so that
+// cassettes can be committed without the credentials they were recorded with,
+// while MatchHeaders still compares them. Hashes of guessable values, like
+// short passwords, can be reversed. Replayed responses carry the redacted
+// values. Defaults to DefaultRedactedHeaders; no
+// header is redacted when names is empty.
+func WithRedactedHeaders(names ...string) Option {
+	return func(r *Recorder) {
+		r.redacted = names
+	}
+}
+
+// New creates a Recorder using cassette in the given mode.
+func New(cassette *Cassette, mode Mode, opts ...Option) *Recorder {
+	r := &Recorder{cassette: cassette, mode: mode, matcher: DefaultMatcher, redacted: DefaultRedactedHeaders}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Misses returns the requests that didn't match any recorded request when
+// replaying, as "METHOD URL" strings.
+func (r *Recorder) Misses() []string {
+	return r.misses.List()
+}
+
+// OnRequest answers requests from the cassette when replaying, and
+// remembers them to be recorded along with their response otherwise.
+func (r *Recorder) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	body, err := replay.ReadBody(req)
+	if err != nil {
+		ctx.Warnf("vcr: cannot read body of %v %v: %v", req.Method, req.URL, err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+	}
+
+	if r.mode == Record {
+		r.pending.Store(ctx, &Interaction{Request: Request{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: redactHeaders(req.Header, r.redacted),
+			Body:   body,
+		}})
+		return req, nil
+	}
+
+	i := r.cassette.find(func(i *Interaction) bool {
+		return r.matcher(req, body, &i.Request)
+	})
+	if i == nil {
+		return r.misses.Handle(req, ctx, "vcr: no recorded request matches", r.passthrough, http.StatusBadGateway)
+	}
+	ctx.Logf("vcr: replaying %v %v", req.Method, req.URL)
+	return req, &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Response.StatusCode, http.StatusText(i.Response.StatusCode)),
+		StatusCode:    i.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(i.Response.Body)),
+		ContentLength: int64(len(i.Response.Body)),
+		Request:       req,
+	}
+}
+
+// OnResponse adds the response to the cassette, when recording.
+func (r *Recorder) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, ok := r.pending.LoadAndDelete(ctx)
+	if !ok || resp == nil {
+		return resp
+	}
+	i := v.(*Interaction) //nolint:forcetypeassert
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		ctx.Warnf("vcr: cannot read response body of %v %v: %v", i.Request.Method, i.Request.URL, err)
+		return resp
+	}
+
+	i.Response = Response{StatusCode: resp.StatusCode, Header: redactHeaders(resp.Header, r.redacted), Body: body}
+	i.RecordedAt = time.Now()
+	r.cassette.Add(i)
+	return resp
+}
+
+// Close saves the cassette when recording. The interactions recorded
+// afterwards are saved by the next call to Close.
+func (r *Recorder) Close() error {
+	if r.mode != Record {
+		return nil
+	}
+	return r.cassette.Save()
+}
@@ -0,0 +1,155 @@
+package vcr_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/internal/proxytest"
+	"github.com/elazarl/goproxy/ext/vcr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newVCRProxy(t *testing.T, r *vcr.Recorder) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(r.OnRequest)
+	proxy.OnResponse().DoFunc(r.OnResponse)
+	return proxytest.NewClient(t, proxy)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	for _, newServer := range []func(http.Handler) *httptest.Server{httptest.NewServer, httptest.NewTLSServer} {
+		path := filepath.Join(t.TempDir(), "cassette.json")
+		counter := 0
+		background := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counter++
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Counter", "yes")
+			_, _ = io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body)+" "+strings.Repeat("!", counter))
+		}))
+
+		cassette, err := vcr.Load(path)
+		require.NoError(t, err)
+		recorder := vcr.New(cassette, vcr.Record)
+		client := newVCRProxy(t, recorder)
+		_, first := proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		_, second := proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		_, post := proxytest.Do(t, client, http.MethodPost, background.URL+"/b", "payload", nil)
+		background.Close()
+		require.NoError(t, recorder.Close())
+
+		// Replay with the destination server gone
+		cassette, err = vcr.Load(path)
+		require.NoError(t, err)
+		require.Len(t, cassette.Interactions(), 3)
+		recorder = vcr.New(cassette, vcr.Replay)
+		client = newVCRProxy(t, recorder)
+
+		_, body := proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		assert.Equal(t, first, body)
+		_, body = proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		assert.Equal(t, second, body, "identical requests are replayed in order")
+		_, body = proxytest.Do(t, client, http.MethodGet, background.URL+"/a", "", nil)
+		assert.Equal(t, second, body, "the last response is replayed once all have been")
+		_, body = proxytest.Do(t, client, http.MethodPost, background.URL+"/b", "payload", nil)
+		assert.Equal(t, post, body)
+		assert.Empty(t, recorder.Misses())
+
+		resp, _ := proxytest.Do(t, client, http.MethodGet, background.URL+"/missing", "", nil)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, []string{"GET " + background.URL + "/missing"}, recorder.Misses())
+	}
+}
+
+func TestReplayMatching(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, "echo "+string(body))
+	}))
+	defer background.Close()
+
+	cassette, err := vcr.Load(path)
+	require.NoError(t, err)
+	recorder := vcr.New(cassette, vcr.Record)
+	client := newVCRProxy(t, recorder)
+	proxytest.Do(t, client, http.MethodPost, background.URL, "one", nil)
+	proxytest.Do(t, client, http.MethodPost, background.URL, "two", nil)
+	require.NoError(t, recorder.Close())
+
+	cassette, err = vcr.Load(path)
+	require.NoError(t, err)
+	matcher := vcr.MatchAll(vcr.DefaultMatcher, vcr.MatchBody, vcr.MatchHeaders("Content-Type"))
+	client = newVCRProxy(t, vcr.New(cassette, vcr.Replay, vcr.WithMatcher(matcher), vcr.WithPassthrough()))
+	_, body := proxytest.Do(t, client, http.MethodPost, background.URL, "two", nil)
+	assert.Equal(t, "echo two", body)
+	_, body = proxytest.Do(t, client, http.MethodPost, background.URL, "one", nil)
+	assert.Equal(t, "echo one", body)
+
+	// Misses reach the destination server
+	_, body = proxytest.Do(t, client, http.MethodPost, background.URL, "three", nil)
+	assert.Equal(t, "echo three", body)
+}
+
+func TestMatchURL(t *testing.T) {
+	// MITM'd requests have the default port, which plain ones don't
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/a?q=1", nil)
+	assert.True(t, vcr.MatchURL(req, nil, &vcr.Request{URL: "https://example.com:443/a?q=1"}))
+	assert.False(t, vcr.MatchURL(req, nil, &vcr.Request{URL: "https://example.com:8443/a?q=1"}))
+	assert.False(t, vcr.MatchURL(req, nil, &vcr.Request{URL: "https://example.com/a?q=2"}))
+}
+
+func TestRedaction(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=s3cret-session")
+		_, _ = io.WriteString(w, "hello "+r.Header.Get("Authorization"))
+	}))
+	defer background.Close()
+	get := func(client *http.Client, token string) (int, string) {
+		t.Helper()
+		resp, body := proxytest.Do(t, client, http.MethodGet, background.URL, "", http.Header{"Authorization": {token}})
+		return resp.StatusCode, body
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cassette, err := vcr.Load(path)
+	require.NoError(t, err)
+	recorder := vcr.New(cassette, vcr.Record)
+	get(newVCRProxy(t, recorder), "Bearer s3cret-token")
+	require.NoError(t, recorder.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Bearer s3cret-token\"")
+	assert.NotContains(t, string(data), "s3cret-session")
+
+	// The redacted header can still be matched
+	cassette, err = vcr.Load(path)
+	require.NoError(t, err)
+	matcher := vcr.MatchAll(vcr.DefaultMatcher, vcr.MatchHeaders("Authorization"))
+	client := newVCRProxy(t, vcr.New(cassette, vcr.Replay, vcr.WithMatcher(matcher)))
+	status, body := get(client, "Bearer s3cret-token")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello Bearer s3cret-token", body)
+	status, _ = get(client, "Bearer other-token")
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	// Without redaction, the headers are recorded verbatim
+	path = filepath.Join(t.TempDir(), "cassette.json")
+	cassette, err = vcr.Load(path)
+	require.NoError(t, err)
+	recorder = vcr.New(cassette, vcr.Record, vcr.WithRedactedHeaders())
+	get(newVCRProxy(t, recorder), "Bearer s3cret-token")
+	require.NoError(t, recorder.Close())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "s3cret-session")
+}
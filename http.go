@@ -1,6 +1,7 @@
 package goproxy
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"strings"
@@ -23,7 +24,7 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 		}
 
 		var err error
-		resp, err = ctx.RoundTrip(r)
+		resp, err = proxy.roundTrip(ctx, r)
 		if err != nil {
 			ctx.Error = err
 		}
@@ -103,10 +104,17 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 		copyWriter = &flushWriter{w: w}
 	}
 
-	nr, err := io.Copy(copyWriter, resp.Body)
+	body := &readErrorReader{r: throttleReader(ctx.Req.Context(), resp.Body, ctx.DownstreamThrottle)}
+	nr, err := io.Copy(copyWriter, body)
 	if err := resp.Body.Close(); err != nil {
 		ctx.Warnf("Can't close response body %v", err)
 	}
+	if body.err != nil {
+		// Like httputil.ReverseProxy, abort the response so that the client
+		// doesn't take the truncated body for a complete one.
+		ctx.Warnf("Error reading response body after %v bytes: %v", nr, body.err)
+		panic(http.ErrAbortHandler)
+	}
 
 	// Forward upstream response trailers. Two cases:
 	//   1. resp.Trailer count == announcedTrailers: every trailer was
@@ -136,3 +144,18 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 	}
 	ctx.Logf("Copied %v bytes to client error=%v", nr, err)
 }
+
+// readErrorReader remembers the error returned by its reader, to tell it
+// apart from the errors writing to the client.
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return n, err
+}
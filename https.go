@@ -3,7 +3,10 @@ package goproxy
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -14,9 +17,11 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/elazarl/goproxy/internal/http1parser"
 	"github.com/elazarl/goproxy/internal/signer"
+	"golang.org/x/net/publicsuffix"
 )
 
 // ConnectActionLiteral defines the action the proxy should take
@@ -86,6 +91,18 @@ func (c *readBufferedConn) Read(p []byte) (int, error) {
 	return c.r.Read(p)
 }
 
+// writeTrackingConn tells whether anything was written to the connection,
+// like the certificate of the proxy during a TLS handshake.
+type writeTrackingConn struct {
+	net.Conn
+	wrote bool
+}
+
+func (c *writeTrackingConn) Write(p []byte) (int, error) {
+	c.wrote = true
+	return c.Conn.Write(p)
+}
+
 // ConnectAction enables the caller to override the standard connect flow.
 // When Action is ConnectHijack, it is up to the implementer to send the
 // HTTP 200, or any other valid http response back to the client from within the
@@ -155,6 +172,8 @@ var _ halfClosable = (*net.TCPConn)(nil)
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
 	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	// The handlers may edit the request, like removing its Proxy-Authorization
+	connectReq := r.Clone(r.Context())
 
 	hij, ok := w.(http.Hijacker)
 	if !ok {
@@ -178,6 +197,11 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			break
 		}
 	}
+	if proxy.MitmBypass != nil && (todo.Action == ConnectMitm || todo.Action == ConnectHTTPMitm) &&
+		proxy.MitmBypass.bypassed(mitmBypassClient(r), host) {
+		ctx.Logf("Tunneling CONNECT to %s, the client rejected the MITM certificates", host)
+		todo = &ConnectAction{Action: ConnectAccept}
+	}
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
@@ -192,14 +216,23 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		ctx.Logf("Accepting CONNECT to %s", host)
 		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
 
+		stats := TunnelStats{Host: host, Start: time.Now()}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		if ctx.OnTunnelClose != nil {
+			go func() {
+				wg.Wait()
+				stats.End = time.Now()
+				ctx.OnTunnelClose(stats)
+			}()
+		}
+
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyClient.(halfClosable)
 		if targetOK && clientOK {
 			go func() {
-				var wg sync.WaitGroup
-				wg.Add(2)
-				go copyAndClose(ctx, targetTCP, proxyClientTCP, &wg)
-				go copyAndClose(ctx, proxyClientTCP, targetTCP, &wg)
+				go copyAndClose(ctx, targetTCP, proxyClientTCP, ctx.UpstreamThrottle, &stats.BytesSent, &wg)
+				go copyAndClose(ctx, proxyClientTCP, targetTCP, ctx.DownstreamThrottle, &stats.BytesReceived, &wg)
 				wg.Wait()
 				// Make sure to close the underlying TCP socket.
 				// CloseRead() and CloseWrite() keep it open until its timeout,
@@ -225,7 +258,9 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			// of the connection remains open until it either times out or is reset by
 			// the client.
 			go func() {
-				err := copyOrWarn(ctx, targetSiteCon, proxyClient)
+				defer wg.Done()
+				var err error
+				stats.BytesSent, err = copyOrWarn(ctx, targetSiteCon, proxyClient, ctx.UpstreamThrottle)
 				if err != nil && proxy.ConnectionErrHandler != nil {
 					proxy.ConnectionErrHandler(proxyClient, ctx, err)
 				}
@@ -233,7 +268,8 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			}()
 
 			go func() {
-				_ = copyOrWarn(ctx, proxyClient, targetSiteCon)
+				defer wg.Done()
+				stats.BytesReceived, _ = copyOrWarn(ctx, proxyClient, targetSiteCon, ctx.DownstreamThrottle)
 				_ = proxyClient.Close()
 			}()
 		}
@@ -273,23 +309,44 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				}
 
 				// Create a TLS connection over the TCP connection
-				rawClientTls := tls.Server(client, tlsConfig)
+				handshakeConn := &writeTrackingConn{Conn: client}
+				rawClientTls := tls.Server(handshakeConn, proxy.withKeyLog(tlsConfig, ctx.Session, "client", host))
 				client = rawClientTls
 				if err := rawClientTls.HandshakeContext(context.Background()); err != nil {
 					ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
+					if proxy.MitmBypass != nil && rejectsCertificate(err, handshakeConn.wrote) {
+						proxy.MitmBypass.failed(mitmBypassClient(r), host)
+					}
 					return
 				}
+				if proxy.MitmBypass != nil {
+					proxy.MitmBypass.succeeded(mitmBypassClient(r), host)
+				}
+
+				if proxy.KeyLogWriter != nil && proxy.Tr != nil {
+					// The secrets of the connections to destination servers are
+					// logged with the session id, so they can't be shared with
+					// other sessions.
+					tr := proxy.Tr.Clone()
+					tr.TLSClientConfig = proxy.withKeyLog(tr.TLSClientConfig, ctx.Session, "upstream", host)
+					ctx.keyLogTransport = tr
+					defer tr.CloseIdleConnections()
+				}
 			}
 
 			clientReader := http1parser.NewRequestReader(proxy.PreventCanonicalization, client)
 			for !clientReader.IsEOF() {
 				req, err := clientReader.ReadRequest()
 				ctx := &ProxyCtx{
-					Req:          req,
-					Session:      atomic.AddInt64(&proxy.sess, 1),
-					Proxy:        proxy,
-					UserData:     ctx.UserData,
-					RoundTripper: ctx.RoundTripper,
+					Req:                req,
+					ConnectReq:         connectReq,
+					Session:            atomic.AddInt64(&proxy.sess, 1),
+					Proxy:              proxy,
+					UserData:           ctx.UserData,
+					RoundTripper:       ctx.RoundTripper,
+					UpstreamThrottle:   ctx.UpstreamThrottle,
+					DownstreamThrottle: ctx.DownstreamThrottle,
+					keyLogTransport:    ctx.keyLogTransport,
 				}
 				if err != nil && !errors.Is(err, io.EOF) {
 					ctx.Warnf("Cannot read request from mitm'd client %v %v", r.Host, err)
@@ -342,7 +399,7 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 								ctx.Warnf("HTTP2 connection failed: disallowed")
 								return false
 							}
-							tr := H2Transport{reader, client, tlsConfig, host}
+							tr := H2Transport{reader, client, proxy.withKeyLog(tlsConfig, ctx.Session, "upstream", host), host}
 							if _, err := tr.RoundTrip(req); err != nil {
 								ctx.Warnf("HTTP2 connection failed: %v", err)
 							} else {
@@ -361,15 +418,24 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						if !proxy.KeepHeader {
 							RemoveProxyHeaders(ctx, req)
 						}
-						resp, err = ctx.RoundTrip(req)
+						resp, err = proxy.roundTrip(ctx, req)
 						if err != nil {
 							ctx.Warnf("Cannot read response from mitm'd server %v", err)
-							return false
+							ctx.Error = err
+						} else {
+							ctx.Logf("resp %v", resp.Status)
 						}
-						ctx.Logf("resp %v", resp.Status)
 					}
-					origBody := resp.Body
+					var origBody io.ReadCloser
+					if resp != nil {
+						origBody = resp.Body
+					}
+					// Like for plain HTTP requests, response handlers are called with
+					// a nil response on errors, giving them a chance to answer anyway.
 					resp = proxy.filterResponse(resp, ctx)
+					if resp == nil {
+						return false
+					}
 					bodyModified := resp.Body != origBody
 					defer resp.Body.Close()
 					if bodyModified || (resp.ContentLength <= 0 && resp.Header.Get("Content-Length") == "") {
@@ -379,9 +445,9 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						// might incorrectly leave it instead of setting it to -1 when the length is unknown (but we
 						// also check that the Content-Length header is empty, so there is no issue with empty bodies).
 						//
-						// 304 Not Modified responses MUST NOT have a body (RFC 7232),
-						// so don't set Transfer-Encoding for them.
-						if resp.StatusCode != http.StatusNotModified {
+						// 204 No Content and 304 Not Modified responses MUST NOT have
+						// a body (RFC 9110, RFC 7232), so don't set Transfer-Encoding for them.
+						if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified {
 							resp.ContentLength = -1
 							resp.Header.Del("Content-Length")
 							resp.TransferEncoding = []string{"chunked"}
@@ -420,6 +486,7 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						return false
 					}
 
+					resp.Body = throttleBody(ctx.Req.Context(), resp.Body, ctx.DownstreamThrottle)
 					if err := resp.Write(client); err != nil {
 						ctx.Warnf("Cannot write response from mitm'd client: %v", err)
 						return false
@@ -464,19 +531,21 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	}
 }
 
-func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader) error {
-	_, err := io.Copy(dst, src)
+func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, throttle Throttle) (int64, error) {
+	// The tunnel outlives the CONNECT request, so its context can't be used
+	n, err := io.Copy(dst, throttleReader(context.Background(), src, throttle))
 	if err != nil && errors.Is(err, net.ErrClosed) {
 		// Discard closed connection errors
 		err = nil
 	} else if err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
-	return err
+	return n, err
 }
 
-func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup) {
-	_, err := io.Copy(dst, src)
+func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, throttle Throttle, written *int64, wg *sync.WaitGroup) {
+	var err error
+	*written, err = io.Copy(dst, throttleReader(context.Background(), src, throttle))
 	if err != nil && !errors.Is(err, net.ErrClosed) {
 		ctx.Warnf("Error copying to client: %s", err.Error())
 	}
@@ -608,24 +677,178 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(
 	return nil
 }
 
+type tlsConfigOptions struct {
+	wildcards       bool
+	wildcardOptOuts []string
+	sniffUpstream   bool
+	namespace       string
+	signer          *signer.Options
+}
+
+// TLSConfigOption is a function type for configuring the certificates generated
+// by TLSConfigFromCA.
+type TLSConfigOption func(*tlsConfigOptions)
+
+// WithWildcardCertificates generates a single wildcard certificate for the hosts
+// sharing a parent domain, like "*.cdn.example.com" (along with "cdn.example.com")
+// for "a.cdn.example.com" and "b.cdn.example.com", instead of one certificate per
+// host. The public suffix list keeps wildcards from covering a public suffix, so
+// "example.com" and "example.co.uk" still get their own certificate.
+// The wildcard certificates are shared through the CertStorage of the proxy.
+func WithWildcardCertificates() TLSConfigOption {
+	return func(o *tlsConfigOptions) {
+		o.wildcards = true
+	}
+}
+
+// WithoutWildcardsFor generates certificates for exactly the requested hostname
+// for the given domains and their subdomains, for clients that reject wildcard
+// certificates.
+func WithoutWildcardsFor(domains ...string) TLSConfigOption {
+	return func(o *tlsConfigOptions) {
+		for _, domain := range domains {
+			o.wildcardOptOuts = append(o.wildcardOptOuts, strings.ToLower(strings.TrimSuffix(domain, ".")))
+		}
+	}
+}
+
+// WithUpstreamSniffing makes the generated certificates mirror the certificate of
+// the real server: a TLS handshake is made with the destination host first, and
+// its subject, subject alternative names and validity (clamped to the one of the
+// CA) are copied. The generated certificates are shared through the CertStorage
+// of the proxy by fingerprint of the server certificate.
+// When the destination host can't be reached, a certificate is generated as if
+// this option wasn't set.
+func WithUpstreamSniffing() TLSConfigOption {
+	return func(o *tlsConfigOptions) {
+		o.sniffUpstream = true
+	}
+}
+
+// WithCertStorageNamespace prefixes the names under which the generated
+// certificates are stored in the CertStorage of the proxy, so that the
+// certificates of different CAs sharing a storage don't collide. The
+// namespaces of several options are concatenated, in order.
+func WithCertStorageNamespace(namespace string) TLSConfigOption {
+	return func(o *tlsConfigOptions) {
+		o.namespace += namespace
+	}
+}
+
+// upstreamSniffingTimeout limits the duration of the TLS handshakes made with
+// destination hosts to get their certificate.
+const upstreamSniffingTimeout = 10 * time.Second
+
+// sniffUpstreamCertificate returns the leaf certificate of the server at host.
+func sniffUpstreamCertificate(ctx *ProxyCtx, host string) (*x509.Certificate, error) {
+	if _, port, err := net.SplitHostPort(host); err != nil || port == "" {
+		host = net.JoinHostPort(stripPort(host), "443")
+	}
+	// The CONNECT request is over by now, and its context canceled
+	sniffCtx, cancel := context.WithTimeout(context.Background(), upstreamSniffingTimeout)
+	defer cancel()
+	dialCtx := *ctx
+	dialCtx.Req = ctx.Req.WithContext(sniffCtx)
+	conn, err := ctx.Proxy.connectDial(&dialCtx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The certificate isn't verified, it is only copied: the requests are
+	// then sent to the server through the transport of the proxy
+	config := defaultTLSConfig.Clone()
+	if hostname := stripPort(host); net.ParseIP(hostname) == nil {
+		config.ServerName = hostname
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(sniffCtx); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate sent by the server")
+	}
+	return certs[0], nil
+}
+
+// wildcardHosts returns the hosts of the wildcard certificate covering hostname,
+// or nil if hostname needs its own certificate.
+func (o *tlsConfigOptions) wildcardHosts(hostname string) []string {
+	if !o.wildcards || net.ParseIP(hostname) != nil {
+		return nil
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, domain := range o.wildcardOptOuts {
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return nil
+		}
+	}
+
+	_, parent, ok := strings.Cut(hostname, ".")
+	if !ok {
+		return nil
+	}
+	// The wildcard must not cover more than a registrable domain
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil || (parent != registrable && !strings.HasSuffix(parent, "."+registrable)) {
+		return nil
+	}
+	return []string{"*." + parent, parent}
+}
+
 // TLSConfigFromCA returns a TLSConfig function that generates dynamic TLS certificates
 // for each target host, signed by the given CA certificate.
 // The generated certificates are used during MITM interception (ConnectMitm).
 // If a CertStorage is set on the ProxyCtx, certificates are cached and reused to save CPU.
-func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
+func TLSConfigFromCA(
+	ca *tls.Certificate,
+	opts ...TLSConfigOption,
+) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
+	var options tlsConfigOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
 	return func(host string, ctx *ProxyCtx) (*tls.Config, error) {
 		var err error
 		var cert *tls.Certificate
 
 		hostname := stripPort(host)
 		config := defaultTLSConfig.Clone()
-		ctx.Logf("signing for %s", stripPort(host))
 
+		// Certificates are stored under the name of their first host, which
+		// is the wildcard shared by the hosts of a domain
+		hosts := options.wildcardHosts(hostname)
+		if hosts == nil {
+			hosts = []string{hostname}
+		}
+		key := hosts[0]
 		genCert := func() (*tls.Certificate, error) {
-			return signer.SignHost(*ca, []string{hostname})
+			return signer.SignHostWithOptions(*ca, hosts, options.signer)
+		}
+
+		if options.sniffUpstream {
+			upstream, err := sniffUpstreamCertificate(ctx, host)
+			if err != nil {
+				ctx.Warnf("Cannot get the certificate of %s, generating one: %v", host, err)
+			} else {
+				// Mirrored certificates are stored under the fingerprint of
+				// the server certificate, and the hostname when it isn't valid
+				// for it, since it is then added to the mirrored certificate
+				fingerprint := sha256.Sum256(upstream.Raw)
+				key = "sha256:" + hex.EncodeToString(fingerprint[:])
+				if upstream.VerifyHostname(hostname) != nil {
+					key += " " + hostname
+				}
+				genCert = func() (*tls.Certificate, error) {
+					return signer.SignMirror(*ca, upstream, hostname, options.signer)
+				}
+			}
 		}
+		ctx.Logf("signing for %s", key)
+
 		if ctx.certStore != nil {
-			cert, err = ctx.certStore.Fetch(hostname, genCert)
+			cert, err = ctx.certStore.Fetch(options.namespace+key, genCert)
 		} else {
 			cert, err = genCert()
 		}
@@ -646,6 +869,7 @@ func (proxy *ProxyHttpServer) initializeTLSconnection(
 	tlsConfig *tls.Config,
 	addr string,
 ) (net.Conn, error) {
+	tlsConfig = proxy.withKeyLog(tlsConfig, ctx.Session, "upstream proxy", addr)
 	// Infer target ServerName, it's a copy of implementation inside tls.Dial()
 	if tlsConfig.ServerName == "" {
 		colonPos := strings.LastIndex(addr, ":")
@@ -11,6 +11,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
 	"net"
@@ -31,7 +32,107 @@ func hashSorted(lst []string) []byte {
 	return h.Sum(nil)
 }
 
+// KeyAlgorithm is the algorithm of the keys of the generated certificates.
+type KeyAlgorithm int
+
+const (
+	// KeyAlgorithmCA generates keys of the algorithm of the CA key, RSA keys
+	// being 2048 bits long and ECDSA keys using P-256.
+	KeyAlgorithmCA KeyAlgorithm = iota
+	RSA2048
+	RSA3072
+	RSA4096
+	ECDSAP256
+	ECDSAP384
+	Ed25519
+)
+
+// Options customizes the generated certificates. The zero value generates the
+// certificates SignHost does.
+type Options struct {
+	KeyAlgorithm KeyAlgorithm
+	// Backdate is how long before their generation the certificates are valid,
+	// 30 days when zero
+	Backdate time.Duration
+	// Validity is how long after their generation the certificates are valid,
+	// 365 days when zero
+	Validity time.Duration
+	// Subject of the certificates, whose CommonName is set to the hostname
+	Subject               pkix.Name
+	KeyUsage              x509.KeyUsage
+	ExtKeyUsage           []x509.ExtKeyUsage
+	OCSPServer            []string
+	IssuingCertificateURL []string
+	CRLDistributionPoints []string
+	ExtraExtensions       []pkix.Extension
+	// SerialNumber returns the serial number of the next certificate, a
+	// random positive 63 bits number when nil
+	SerialNumber func() (*big.Int, error)
+	// KeySource returns a ready key of algorithm, or nil to generate one
+	KeySource func(algorithm KeyAlgorithm) crypto.Signer
+}
+
+var defaultOptions = &Options{}
+
+// template returns the template of a certificate signed by x509ca, with the
+// attributes that don't depend on its hosts.
+func (o *Options) template(x509ca *x509.Certificate) (*x509.Certificate, error) {
+	var serial *big.Int
+	if o.SerialNumber != nil {
+		var err error
+		if serial, err = o.SerialNumber(); err != nil {
+			return nil, err
+		}
+	} else {
+		// Always generate a positive int value
+		// (Two complement is not enabled when the first bit is 0)
+		serial = big.NewInt(int64(rand.Uint64() >> 1))
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Issuer:       x509ca.Subject,
+		Subject:      o.Subject,
+
+		KeyUsage:              o.KeyUsage,
+		ExtKeyUsage:           o.ExtKeyUsage,
+		OCSPServer:            o.OCSPServer,
+		IssuingCertificateURL: o.IssuingCertificateURL,
+		CRLDistributionPoints: o.CRLDistributionPoints,
+		ExtraExtensions:       o.ExtraExtensions,
+		BasicConstraintsValid: true,
+	}
+	if template.Subject.String() == "" {
+		template.Subject = pkix.Name{Organization: []string{"GoProxy untrusted MITM proxy Inc"}}
+	}
+	if template.KeyUsage == 0 {
+		template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	if template.ExtKeyUsage == nil {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	return template, nil
+}
+
+// seed returns the values identifying the key of a certificate, along with
+// the names it is generated for.
+func (o *Options) seed() []string {
+	seed := []string{_goproxySignerVersion, ":" + runtime.Version()}
+	if o.KeyAlgorithm != KeyAlgorithmCA {
+		seed = append(seed, fmt.Sprintf(":key%d", o.KeyAlgorithm))
+	}
+	return seed
+}
+
 func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+	return SignHostWithOptions(ca, hosts, nil)
+}
+
+// SignHostWithOptions creates a certificate for hosts, customized by opts.
+func SignHostWithOptions(ca tls.Certificate, hosts []string, opts *Options) (cert *tls.Certificate, err error) {
+	if opts == nil {
+		opts = defaultOptions
+	}
 	// Use the provided CA for certificate generation.
 	// Use already parsed Leaf certificate when present.
 	x509ca := ca.Leaf
@@ -41,28 +142,21 @@ func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		}
 	}
 
+	template, err := opts.template(x509ca)
+	if err != nil {
+		return nil, err
+	}
+	backdate, validity := opts.Backdate, opts.Validity
+	if backdate == 0 {
+		backdate = 30 * 24 * time.Hour
+	}
+	if validity == 0 {
+		validity = 365 * 24 * time.Hour
+	}
 	now := time.Now()
-	start := now.Add(-30 * 24 * time.Hour) // -30 days
-	end := now.Add(365 * 24 * time.Hour)   // 365 days
+	template.NotBefore = now.Add(-backdate)
+	template.NotAfter = now.Add(validity)
 
-	// Always generate a positive int value
-	// (Two complement is not enabled when the first bit is 0)
-	generated := rand.Uint64()
-	generated >>= 1
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(int64(generated)),
-		Issuer:       x509ca.Subject,
-		Subject: pkix.Name{
-			Organization: []string{"GoProxy untrusted MITM proxy Inc"},
-		},
-		NotBefore: start,
-		NotAfter:  end,
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
 	for _, h := range hosts {
 		if ip := net.ParseIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
@@ -72,31 +166,130 @@ func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		}
 	}
 
-	hash := hashSorted(append(hosts, _goproxySignerVersion, ":"+runtime.Version()))
-	var csprng CounterEncryptorRand
-	if csprng, err = NewCounterEncryptorRandFromKey(ca.PrivateKey, hash); err != nil {
+	hash := hashSorted(append(append([]string{}, hosts...), opts.seed()...))
+	return sign(ca, x509ca, template, hash, opts)
+}
+
+// SignMirror creates a certificate copying the subject, the subject alternative
+// names and the validity of upstream, the certificate of the real server.
+// The validity is clamped to the one of the CA. hostname is added to the names
+// when upstream isn't valid for it. The other attributes are customized by opts.
+func SignMirror(
+	ca tls.Certificate,
+	upstream *x509.Certificate,
+	hostname string,
+	opts *Options,
+) (cert *tls.Certificate, err error) {
+	if opts == nil {
+		opts = defaultOptions
+	}
+	x509ca := ca.Leaf
+	if x509ca == nil {
+		if x509ca, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	template, err := opts.template(x509ca)
+	if err != nil {
 		return nil, err
 	}
+	template.Subject = upstream.Subject
+	template.Subject.Names = nil
+	template.NotBefore = upstream.NotBefore
+	template.NotAfter = upstream.NotAfter
+	template.DNSNames = upstream.DNSNames
+	template.IPAddresses = upstream.IPAddresses
+	template.URIs = upstream.URIs
+	template.EmailAddresses = upstream.EmailAddresses
+	if template.NotBefore.Before(x509ca.NotBefore) {
+		template.NotBefore = x509ca.NotBefore
+	}
+	if template.NotAfter.After(x509ca.NotAfter) {
+		template.NotAfter = x509ca.NotAfter
+	}
 
-	var certpriv crypto.Signer
-	switch ca.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		if certpriv, err = rsa.GenerateKey(&csprng, 2048); err != nil {
-			return nil, err
+	fingerprint := sha256.Sum256(upstream.Raw)
+	seed := append([]string{fmt.Sprintf("%x", fingerprint)}, opts.seed()...)
+	if upstream.VerifyHostname(hostname) != nil {
+		if ip := net.ParseIP(hostname); ip != nil {
+			template.IPAddresses = append(template.IPAddresses[:len(template.IPAddresses):len(template.IPAddresses)], ip)
+		} else {
+			template.DNSNames = append(template.DNSNames[:len(template.DNSNames):len(template.DNSNames)], hostname)
 		}
+		seed = append(seed, hostname)
+	}
+	return sign(ca, x509ca, template, hashSorted(seed), opts)
+}
+
+// ResolveKeyAlgorithm returns the algorithm of the keys generated with
+// algorithm for caKey, replacing KeyAlgorithmCA with the one of caKey.
+func ResolveKeyAlgorithm(algorithm KeyAlgorithm, caKey any) (KeyAlgorithm, error) {
+	if algorithm != KeyAlgorithmCA {
+		return algorithm, nil
+	}
+	switch caKey.(type) {
+	case *rsa.PrivateKey:
+		return RSA2048, nil
 	case *ecdsa.PrivateKey:
-		if certpriv, err = ecdsa.GenerateKey(elliptic.P256(), &csprng); err != nil {
-			return nil, err
-		}
+		return ECDSAP256, nil
 	case ed25519.PrivateKey:
-		if _, certpriv, err = ed25519.GenerateKey(&csprng); err != nil {
+		return Ed25519, nil
+	default:
+		return algorithm, fmt.Errorf("unsupported key type %T", caKey)
+	}
+}
+
+// GenerateKey generates a key of algorithm, which can't be KeyAlgorithmCA.
+func GenerateKey(rand io.Reader, algorithm KeyAlgorithm) (crypto.Signer, error) {
+	switch algorithm {
+	case RSA2048:
+		return rsa.GenerateKey(rand, 2048)
+	case RSA3072:
+		return rsa.GenerateKey(rand, 3072)
+	case RSA4096:
+		return rsa.GenerateKey(rand, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %d", algorithm)
+	}
+}
+
+// sign signs template with ca. The private key of the certificate comes from
+// the key source of opts, or is generated from hash, so that the same
+// certificate gets the same key.
+func sign(
+	ca tls.Certificate,
+	x509ca, template *x509.Certificate,
+	hash []byte,
+	opts *Options,
+) (cert *tls.Certificate, err error) {
+	var csprng CounterEncryptorRand
+	if csprng, err = NewCounterEncryptorRandFromKey(ca.PrivateKey, hash); err != nil {
+		return nil, err
+	}
+
+	algorithm, err := ResolveKeyAlgorithm(opts.KeyAlgorithm, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	var certpriv crypto.Signer
+	if opts.KeySource != nil {
+		certpriv = opts.KeySource(algorithm)
+	}
+	if certpriv == nil {
+		if certpriv, err = GenerateKey(&csprng, algorithm); err != nil {
 			return nil, err
 		}
-	default:
-		return nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
 	}
 
-	derBytes, err := x509.CreateCertificate(&csprng, &template, x509ca, certpriv.Public(), ca.PrivateKey)
+	derBytes, err := x509.CreateCertificate(&csprng, template, x509ca, certpriv.Public(), ca.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -2,13 +2,20 @@ package signer_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/elazarl/goproxy"
 	"github.com/elazarl/goproxy/internal/signer"
@@ -91,6 +98,65 @@ func TestSignerEcdsaX509(t *testing.T) {
 	testSignerX509(t, EcdsaCa)
 }
 
+func TestSignerOptions(t *testing.T) {
+	var serial int64
+	policy := asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1}
+	policies, err := asn1.Marshal([]struct{ Policy asn1.ObjectIdentifier }{{policy}})
+	orFatal(t, "asn1.Marshal", err)
+	opts := &signer.Options{
+		KeyAlgorithm:          signer.ECDSAP384,
+		Backdate:              time.Hour,
+		Validity:              24 * time.Hour,
+		Subject:               pkix.Name{Organization: []string{"Acme"}, Country: []string{"IL"}},
+		OCSPServer:            []string{"http://ocsp.example.com"},
+		CRLDistributionPoints: []string{"http://crl.example.com/ca.crl"},
+		ExtraExtensions:       []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 32}, Value: policies}},
+		SerialNumber: func() (*big.Int, error) {
+			return big.NewInt(atomic.AddInt64(&serial, 1)), nil
+		},
+	}
+
+	cert, err := signer.SignHostWithOptions(goproxy.GoproxyCa, []string{"example.com"}, opts)
+	orFatal(t, "SignHostWithOptions", err)
+	leaf := cert.Leaf
+	orFatal(t, "CheckSignatureFrom", leaf.CheckSignatureFrom(goproxy.GoproxyCa.Leaf))
+	key, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P384() {
+		t.Errorf("Expected a P-384 key, got %T", leaf.PublicKey)
+	}
+	if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity != 25*time.Hour {
+		t.Errorf("Expected a validity of 25h, got %v", validity)
+	}
+	if subject := leaf.Subject.String(); subject != "CN=example.com,O=Acme,C=IL" {
+		t.Errorf("Unexpected subject %s", subject)
+	}
+	if len(leaf.OCSPServer) != 1 || len(leaf.CRLDistributionPoints) != 1 {
+		t.Errorf("Unexpected revocation URLs %v %v", leaf.OCSPServer, leaf.CRLDistributionPoints)
+	}
+	if len(leaf.PolicyIdentifiers) != 1 || !leaf.PolicyIdentifiers[0].Equal(policy) {
+		t.Errorf("Unexpected policies %v", leaf.PolicyIdentifiers)
+	}
+	if leaf.SerialNumber.Int64() != 1 {
+		t.Errorf("Expected serial number 1, got %v", leaf.SerialNumber)
+	}
+
+	cert, err = signer.SignHostWithOptions(goproxy.GoproxyCa, []string{"example.com"}, opts)
+	orFatal(t, "SignHostWithOptions", err)
+	if cert.Leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected serial number 2, got %v", cert.Leaf.SerialNumber)
+	}
+
+	// The default options sign the certificates SignHost does
+	cert, err = signer.SignHostWithOptions(EcdsaCa, []string{"example.com"}, &signer.Options{})
+	orFatal(t, "SignHostWithOptions", err)
+	if cert.Leaf.Subject.Organization[0] != "GoProxy untrusted MITM proxy Inc" {
+		t.Errorf("Unexpected subject %s", cert.Leaf.Subject)
+	}
+	if _, ok := cert.Leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected an ECDSA key, got %T", cert.Leaf.PublicKey)
+	}
+}
+
 func BenchmarkSignRsa(b *testing.B) {
 	var cert *tls.Certificate
 	var err error
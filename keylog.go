@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+)
+
+// keyLogWriter writes the TLS secrets of a handshake to the KeyLogWriter of
+// the proxy, each line preceded by a comment identifying its session.
+type keyLogWriter struct {
+	proxy   *ProxyHttpServer
+	session int64
+	side    string
+	host    string
+}
+
+func (w *keyLogWriter) Write(line []byte) (int, error) {
+	comment := fmt.Sprintf("# goproxy session %d, %s handshake for %s\n", w.session, w.side, w.host)
+	// Lines of concurrent handshakes must not be interleaved
+	w.proxy.keyLogMtx.Lock()
+	defer w.proxy.keyLogMtx.Unlock()
+	if _, err := io.WriteString(w.proxy.KeyLogWriter, comment+string(line)); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+// withKeyLog returns a copy of config logging the secrets of its handshakes,
+// or config itself when the proxy has no KeyLogWriter.
+func (proxy *ProxyHttpServer) withKeyLog(config *tls.Config, session int64, side, host string) *tls.Config {
+	if proxy.KeyLogWriter == nil {
+		return config
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.KeyLogWriter = &keyLogWriter{proxy: proxy, session: session, side: side, host: host}
+	return config
+}
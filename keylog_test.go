@@ -0,0 +1,82 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func nonEmptyLines(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == '\n' })
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	// The secrets logged by the client and the server of each handshake
+	// must be the ones logged by the proxy
+	var serverKeys, clientKeys, proxyKeys syncBuffer
+	server := httptest.NewUnstartedServer(ConstantHanlder("secret"))
+	server.TLS = &tls.Config{KeyLogWriter: &serverKeys}
+	server.StartTLS()
+	defer server.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.KeyLogWriter = &proxyKeys
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+	client.Transport.(*http.Transport).TLSClientConfig.KeyLogWriter = &clientKeys
+
+	assert.Equal(t, "secret", string(getOrFail(t, server.URL+"/", client)))
+	client.CloseIdleConnections()
+
+	logged := nonEmptyLines(proxyKeys.String())
+	require.NotEmpty(t, logged)
+	for n, line := range logged {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		require.Positive(t, n, "secrets should follow a comment")
+		comment := logged[n-1]
+		switch {
+		case strings.Contains(comment, "client handshake"):
+			assert.Contains(t, clientKeys.String(), line)
+		case strings.Contains(comment, "upstream handshake"):
+			assert.Contains(t, serverKeys.String(), line)
+		default:
+			t.Errorf("Unexpected comment %q", comment)
+		}
+		assert.Regexp(t, `^# goproxy session \d+, `, comment)
+	}
+	for _, line := range nonEmptyLines(clientKeys.String()) {
+		assert.Contains(t, logged, line, "client secrets should be logged")
+	}
+	for _, line := range nonEmptyLines(serverKeys.String()) {
+		assert.Contains(t, logged, line, "server secrets should be logged")
+	}
+}
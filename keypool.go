@@ -0,0 +1,130 @@
+package goproxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy/internal/signer"
+)
+
+// KeyPool keeps keys generated in the background ready for the certificates
+// of MITM'd hosts, so that handshakes with new hosts don't wait for a key
+// generation, RSA ones taking tens of milliseconds. Set it in SignerOptions.
+//
+//	pool, err := goproxy.NewKeyPool(goproxy.KeyAlgorithmRSA2048, 64, 1)
+//	...
+//	defer pool.Close()
+//	tlsConfig := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa,
+//		goproxy.WithSignerOptions(goproxy.SignerOptions{KeyPool: pool}))
+//
+// The keys are only used for certificates of the algorithm of the pool.
+// Certificates get a new key each time they are generated, instead of a key
+// derived from their hostnames.
+type KeyPool struct {
+	algorithm signer.KeyAlgorithm
+	keys      chan crypto.Signer
+	done      chan struct{}
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	generated atomic.Int64
+	errors    atomic.Int64
+}
+
+// KeyPoolStats describes the usage of a KeyPool.
+type KeyPoolStats struct {
+	// Size is the number of keys the pool keeps ready, Ready the number of
+	// keys currently ready
+	Size  int
+	Ready int
+	// Hits counts the keys taken from the pool, Misses the keys that were
+	// generated by the signer because the pool was exhausted
+	Hits   int64
+	Misses int64
+	// Generated counts the keys generated by the pool, Errors the failed
+	// generations
+	Generated int64
+	Errors    int64
+}
+
+// NewKeyPool creates a KeyPool keeping size keys of algorithm ready,
+// generated by workers goroutines, which bound the CPU used by the pool.
+// algorithm can't be KeyAlgorithmCA.
+func NewKeyPool(algorithm KeyAlgorithm, size, workers int) (*KeyPool, error) {
+	if algorithm == KeyAlgorithmCA {
+		return nil, errors.New("the algorithm of the keys of a pool must be explicit")
+	}
+	if size <= 0 || workers <= 0 {
+		return nil, errors.New("the size and the workers of a key pool must be positive")
+	}
+	p := &KeyPool{
+		algorithm: signer.KeyAlgorithm(algorithm),
+		keys:      make(chan crypto.Signer, size),
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.refill()
+	}
+	return p, nil
+}
+
+func (p *KeyPool) refill() {
+	defer p.workers.Done()
+	for {
+		key, err := signer.GenerateKey(rand.Reader, p.algorithm)
+		if err != nil {
+			// Can only fail for unsupported algorithms
+			p.errors.Add(1)
+			return
+		}
+		p.generated.Add(1)
+		select {
+		case p.keys <- key:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// key returns a ready key, or nil if the pool is exhausted or for another
+// algorithm.
+func (p *KeyPool) key(algorithm signer.KeyAlgorithm) crypto.Signer {
+	if algorithm != p.algorithm {
+		return nil
+	}
+	select {
+	case key := <-p.keys:
+		p.hits.Add(1)
+		return key
+	default:
+		p.misses.Add(1)
+		return nil
+	}
+}
+
+// Stats returns the usage of the pool.
+func (p *KeyPool) Stats() KeyPoolStats {
+	return KeyPoolStats{
+		Size:      cap(p.keys),
+		Ready:     len(p.keys),
+		Hits:      p.hits.Load(),
+		Misses:    p.misses.Load(),
+		Generated: p.generated.Load(),
+		Errors:    p.errors.Load(),
+	}
+}
+
+// Close stops the generation of keys, waiting for the ongoing ones. The keys
+// that are ready are still used.
+func (p *KeyPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	p.workers.Wait()
+}
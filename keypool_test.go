@@ -0,0 +1,51 @@
+package goproxy_test
+
+import (
+	"crypto/x509"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPool(t *testing.T) {
+	_, err := goproxy.NewKeyPool(goproxy.KeyAlgorithmCA, 4, 1)
+	require.Error(t, err)
+
+	pool, err := goproxy.NewKeyPool(goproxy.KeyAlgorithmECDSAP256, 4, 2)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return pool.Stats().Ready == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	// Keep the pool from being refilled, so that it gets exhausted
+	pool.Close()
+
+	tlsConfig := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa,
+		goproxy.WithSignerOptions(goproxy.SignerOptions{KeyAlgorithm: goproxy.KeyAlgorithmECDSAP256, KeyPool: pool}))
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	for i := 0; i < 6; i++ {
+		config, err := tlsConfig("host"+strconv.Itoa(i)+".example.com:443", ctx)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		assert.Equal(t, x509.ECDSA, leaf.PublicKeyAlgorithm)
+	}
+
+	stats := pool.Stats()
+	assert.Equal(t, 4, stats.Size)
+	assert.Zero(t, stats.Ready)
+	assert.Equal(t, int64(4), stats.Hits)
+	assert.Equal(t, int64(2), stats.Misses)
+	assert.GreaterOrEqual(t, stats.Generated, int64(4))
+	assert.Zero(t, stats.Errors)
+
+	// The keys of a pool are not used for certificates of another algorithm
+	rsaConfig := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa,
+		goproxy.WithSignerOptions(goproxy.SignerOptions{KeyPool: pool}))
+	_, err = rsaConfig("example.com:443", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), pool.Stats().Misses)
+}
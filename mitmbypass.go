@@ -0,0 +1,229 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultMitmBypassThreshold is the number of consecutive rejected client
+	// handshakes after which a host is tunneled, when MitmBypass.Threshold is zero.
+	DefaultMitmBypassThreshold = 3
+	// DefaultMitmBypassDuration is how long a host is tunneled, when
+	// MitmBypass.Duration is zero.
+	DefaultMitmBypassDuration = time.Hour
+)
+
+// MitmBypass tunnels the CONNECT requests that would be MITM'd, with
+// ConnectAccept, for the clients that repeatedly rejected the certificate of
+// the proxy for the same host, like apps pinning the certificates of their
+// servers. Set it as the MitmBypass of the proxy:
+//
+//	proxy.MitmBypass = &goproxy.MitmBypass{Duration: 24 * time.Hour}
+//
+// A handshake fails this way when the client sends a bad_certificate,
+// certificate_unknown or unknown_ca alert, or closes the connection once the
+// proxy sent its certificate. Clients are identified by their IP address. A
+// successful handshake resets the count of failures of a client with a host.
+// The bypasses expire after Duration, the next CONNECTs of the client to the
+// host being MITM'd again.
+//
+// MitmBypass is an http.Handler serving the current bypasses, see ServeHTTP.
+// The zero value is ready to use.
+type MitmBypass struct {
+	// Threshold is the number of consecutive rejected handshakes of a client
+	// with a host after which the host is tunneled for this client,
+	// DefaultMitmBypassThreshold when zero
+	Threshold int
+	// Duration is how long the host is then tunneled, DefaultMitmBypassDuration
+	// when zero
+	Duration time.Duration
+
+	mtx     sync.Mutex
+	entries map[mitmBypassKey]*MitmBypassEntry
+}
+
+// MitmBypassEntry is a host tunneled for a client.
+type MitmBypassEntry struct {
+	// Client is the IP address of the client
+	Client string `json:"client"`
+	// Host is the host of the CONNECT requests, with its port
+	Host string `json:"host"`
+	// Failures is the number of consecutive rejected handshakes
+	Failures int `json:"failures"`
+	// Until is when the host is MITM'd again
+	Until time.Time `json:"until"`
+}
+
+type mitmBypassKey struct {
+	client, host string
+}
+
+func (b *MitmBypass) threshold() int {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return DefaultMitmBypassThreshold
+}
+
+func (b *MitmBypass) duration() time.Duration {
+	if b.Duration > 0 {
+		return b.Duration
+	}
+	return DefaultMitmBypassDuration
+}
+
+// rejectsCertificate reports whether err, returned by the handshake of a
+// client, tells that the client rejected the certificate of the proxy: an
+// alert about the certificate, or the connection closed after the proxy sent
+// it, which clients do instead of sending an alert. Other errors, like clients
+// disconnecting before, timeouts or non-TLS clients, don't involve it.
+func rejectsCertificate(err error, certificateSent bool) bool {
+	if code, ok := receivedAlert(err); ok {
+		switch code {
+		case 42, // bad_certificate
+			46, // certificate_unknown
+			48: // unknown_ca
+			return true
+		}
+		return false
+	}
+	return certificateSent && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET))
+}
+
+// receivedAlert returns the code of the TLS alert sent by the peer that err
+// reports. crypto/tls reports them as a "remote error" net.OpError wrapping
+// an unexported alert type, which like tls.AlertError is a uint8 holding the
+// code.
+func receivedAlert(err error) (tls.AlertError, bool) {
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return alertErr, true
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return 0, false
+	}
+	if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+		return tls.AlertError(v.Uint()), true
+	}
+	return 0, false
+}
+
+// mitmBypassClient returns the IP address of the client of r.
+func mitmBypassClient(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return client
+}
+
+// bypassed reports whether host is tunneled for client.
+func (b *MitmBypass) bypassed(client, host string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := mitmBypassKey{client, host}
+	e, ok := b.entries[key]
+	if !ok || e.Failures < b.threshold() {
+		return false
+	}
+	if time.Now().After(e.Until) {
+		delete(b.entries, key)
+		return false
+	}
+	return true
+}
+
+// failed records a handshake of client with host rejecting the certificate.
+func (b *MitmBypass) failed(client, host string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	// Failures are rare, the expired entries are dropped here so that the
+	// ones of clients that never reach the threshold don't accumulate.
+	for key, e := range b.entries {
+		if now.After(e.Until) {
+			delete(b.entries, key)
+		}
+	}
+	if b.entries == nil {
+		b.entries = make(map[mitmBypassKey]*MitmBypassEntry)
+	}
+	key := mitmBypassKey{client, host}
+	e, ok := b.entries[key]
+	if !ok {
+		e = &MitmBypassEntry{Client: client, Host: host}
+		b.entries[key] = e
+	}
+	e.Failures++
+	e.Until = now.Add(b.duration())
+}
+
+// succeeded records a successful handshake of client with host.
+func (b *MitmBypass) succeeded(client, host string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.entries, mitmBypassKey{client, host})
+}
+
+// List returns the hosts currently tunneled, sorted by client and host.
+func (b *MitmBypass) List() []MitmBypassEntry {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	list := []MitmBypassEntry{}
+	for _, e := range b.entries {
+		if e.Failures >= b.threshold() && !now.After(e.Until) {
+			list = append(list, *e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Client != list[j].Client {
+			return list[i].Client < list[j].Client
+		}
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+// Remove MITMs host again for client, reporting whether it was tunneled.
+func (b *MitmBypass) Remove(client, host string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := mitmBypassKey{client, host}
+	e, ok := b.entries[key]
+	delete(b.entries, key)
+	return ok && e.Failures >= b.threshold() && !time.Now().After(e.Until)
+}
+
+// ServeHTTP serves the list of the tunneled hosts as JSON on GET requests,
+// and removes the host tunneled for a client on DELETE requests, given by
+// the client and host query parameters. It should only be exposed to the
+// administrators of the proxy, for example through a NonproxyHandler.
+func (b *MitmBypass) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(b.List())
+	case http.MethodDelete:
+		query := r.URL.Query()
+		if !b.Remove(query.Get("client"), query.Get("host")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,142 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMitmBypass(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmBypass = &goproxy.MitmBypass{Threshold: 2}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// The client only trusts the certificate of the server, like apps
+	// pinning it, so it rejects the MITM certificates.
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{
+			RootCAs: https.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		},
+		DisableKeepAlives: true,
+	}}
+	host := https.Listener.Addr().String()
+
+	for i := 0; i < 2; i++ {
+		_, err := get(https.URL+"/bobo", client)
+		require.Error(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return len(proxy.MitmBypass.List()) == 1
+	}, time.Second, 10*time.Millisecond)
+	entry := proxy.MitmBypass.List()[0]
+	assert.Equal(t, "127.0.0.1", entry.Client)
+	assert.Equal(t, host, entry.Host)
+	assert.Equal(t, 2, entry.Failures)
+	assert.WithinDuration(t, time.Now().Add(goproxy.DefaultMitmBypassDuration), entry.Until, time.Minute)
+
+	// The host is now tunneled
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+
+	rec := httptest.NewRecorder()
+	proxy.MitmBypass.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var list []goproxy.MitmBypassEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, entry.Host, list[0].Host)
+	assert.True(t, entry.Until.Equal(list[0].Until))
+
+	rec = httptest.NewRecorder()
+	proxy.MitmBypass.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete,
+		"/?client=127.0.0.1&host="+url.QueryEscape(host), nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, proxy.MitmBypass.List())
+	assert.False(t, proxy.MitmBypass.Remove("127.0.0.1", host))
+
+	// The host is MITM'd again
+	_, err := get(https.URL+"/bobo", client)
+	require.Error(t, err)
+}
+
+func TestMitmBypassSuccessResetsFailures(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmBypass = &goproxy.MitmBypass{Threshold: 2}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	rejecting := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		DisableKeepAlives: true,
+	}}
+	accepting := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	_, err := get(https.URL+"/bobo", rejecting)
+	require.Error(t, err)
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", accepting)))
+	_, err = get(https.URL+"/bobo", rejecting)
+	require.Error(t, err)
+	// Let the proxy record the last failure
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, proxy.MitmBypass.List())
+}
+
+func TestMitmBypassIgnoresDisconnects(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmBypass = &goproxy.MitmBypass{Threshold: 1}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	host := https.Listener.Addr().String()
+
+	// Clients leaving before the proxy sent its certificate didn't reject it
+	for name, data := range map[string]string{
+		"disconnect":     "",
+		"not a hello":    "\x16\x03\x01\x00\x05hello",
+		"partial record": "\x16\x03\x01",
+	} {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err, name)
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		require.NoError(t, err, name)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, name)
+		_, err = io.WriteString(conn, data)
+		require.NoError(t, err, name)
+		require.NoError(t, conn.Close(), name)
+	}
+	// Let the proxy record the failures
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, proxy.MitmBypass.List())
+
+	proxyURL, _ := url.Parse(s.URL)
+	rejecting := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		DisableKeepAlives: true,
+	}}
+	_, err := get(https.URL+"/bobo", rejecting)
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return len(proxy.MitmBypass.List()) == 1
+	}, time.Second, 10*time.Millisecond)
+}
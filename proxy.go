@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sync"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -68,6 +69,22 @@ type ProxyHttpServer struct {
 	// Accept-Encoding header. To disable this behavior, set
 	// Tr.DisableCompression to true.
 	KeepAcceptEncoding bool
+	// Retry, when set, makes the proxy retry requests whose round trip to the
+	// destination server failed with a transient error or status code.
+	// See RetryPolicy for which requests are eligible.
+	Retry *RetryPolicy
+	// MitmBypass, when set, tunnels the hosts that would be MITM'd for the
+	// clients repeatedly rejecting the certificates of the proxy.
+	MitmBypass *MitmBypass
+	// KeyLogWriter, when set, receives the TLS secrets of MITM'd connections,
+	// on both the client and the destination server sides, in NSS key log
+	// format, so that tools like Wireshark can decrypt captured traffic.
+	// Each line is preceded by a comment with the session id of the CONNECT
+	// request. To tell sessions apart, each MITM'd connection then uses its
+	// own connections to destination servers.
+	// This compromises the security of the traffic: use it for debugging only.
+	KeyLogWriter io.Writer
+	keyLogMtx    sync.Mutex
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
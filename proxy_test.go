@@ -7,6 +7,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -23,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -400,6 +402,50 @@ func TestConnectHandler(t *testing.T) {
 	}
 }
 
+func TestTunnelStats(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	stats := make(chan goproxy.TunnelStats, 1)
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.OnTunnelClose = func(s goproxy.TunnelStats) {
+			stats <- s
+		}
+		return goproxy.OkConnect, host
+	})
+	_, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	proxyURL, _ := url.Parse(l.URL)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+srvURL.Host+" HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req := "GET /bobo HTTP/1.1\r\nHost: " + srvURL.Host + "\r\nConnection: close\r\n\r\n"
+	_, err = io.WriteString(conn, req)
+	require.NoError(t, err)
+	// The server closes the tunnel after its response
+	received, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Contains(t, string(received), "bobo")
+	_ = conn.Close()
+
+	select {
+	case s := <-stats:
+		assert.Equal(t, srvURL.Host, s.Host)
+		assert.False(t, s.End.Before(s.Start))
+		assert.Equal(t, int64(len(req)), s.BytesSent)
+		assert.Equal(t, int64(len(received)), s.BytesReceived)
+	case <-time.After(time.Second):
+		t.Fatal("Tunnel close not reported")
+	}
+}
+
 func TestMitmIsFiltered(t *testing.T) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
@@ -890,6 +936,117 @@ func TestProxyWithCertStorage(t *testing.T) {
 	}
 }
 
+func TestProxyWithWildcardCertificates(t *testing.T) {
+	tcs := newTestCertStorage()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = tcs
+	mitm := &goproxy.ConnectAction{
+		Action: goproxy.ConnectMitm,
+		TLSConfig: goproxy.TLSConfigFromCA(&goproxy.GoproxyCa,
+			goproxy.WithWildcardCertificates(), goproxy.WithoutWildcardsFor("legacy.example.com")),
+	}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, req.Host)
+	})
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	testCases := []struct {
+		host     string
+		dnsNames []string
+	}{
+		{host: "a.cdn.example.com", dnsNames: []string{"*.cdn.example.com", "cdn.example.com"}},
+		{host: "b.cdn.example.com", dnsNames: []string{"*.cdn.example.com", "cdn.example.com"}},
+		{host: "example.com", dnsNames: []string{"example.com"}},
+		{host: "www.example.co.uk", dnsNames: []string{"*.example.co.uk", "example.co.uk"}},
+		{host: "a.legacy.example.com", dnsNames: []string{"a.legacy.example.com"}},
+		{host: "localhost", dnsNames: []string{"localhost"}},
+	}
+	for _, tc := range testCases {
+		resp, err := client.Get("https://" + tc.host + "/")
+		require.NoError(t, err, tc.host)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, tc.host, string(body))
+		require.NotNil(t, resp.TLS)
+		assert.Equal(t, tc.dnsNames, resp.TLS.PeerCertificates[0].DNSNames, tc.host)
+	}
+	assert.Equal(t, 1, tcs.statHits())
+	assert.Equal(t, 5, tcs.statMisses())
+	assert.Contains(t, tcs.certs, "*.cdn.example.com")
+}
+
+func TestProxyWithUpstreamSniffing(t *testing.T) {
+	tcs := newTestCertStorage()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = tcs
+	mitm := &goproxy.ConnectAction{
+		Action:    goproxy.ConnectMitm,
+		TLSConfig: goproxy.TLSConfigFromCA(&goproxy.GoproxyCa, goproxy.WithUpstreamSniffing()),
+	}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	})
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+	// Every request makes a new handshake
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+
+	upstream := https.Certificate()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(https.URL + "/bobo")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.NotNil(t, resp.TLS)
+		mirrored := resp.TLS.PeerCertificates[0]
+		assert.Equal(t, upstream.DNSNames, mirrored.DNSNames)
+		assert.Len(t, mirrored.IPAddresses, len(upstream.IPAddresses))
+		assert.Equal(t, upstream.Subject.Organization, mirrored.Subject.Organization)
+
+		// The validity is clamped to the one of the CA
+		notBefore, notAfter := upstream.NotBefore, upstream.NotAfter
+		if ca := goproxy.GoproxyCa.Leaf; ca.NotBefore.After(notBefore) {
+			notBefore = ca.NotBefore
+		}
+		if ca := goproxy.GoproxyCa.Leaf; ca.NotAfter.Before(notAfter) {
+			notAfter = ca.NotAfter
+		}
+		assert.Equal(t, notBefore, mirrored.NotBefore)
+		assert.Equal(t, notAfter, mirrored.NotAfter)
+	}
+	assert.Equal(t, 1, tcs.statMisses())
+	assert.Equal(t, 1, tcs.statHits())
+
+	// Unreachable hosts get a generated certificate
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: "127.0.0.1:1"}, Host: "127.0.0.1:1"}
+	config, err := mitm.TLSConfig("127.0.0.1:1", &goproxy.ProxyCtx{Req: req, Proxy: proxy})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GoProxy untrusted MITM proxy Inc"}, leaf.Subject.Organization)
+}
+
+func TestTLSConfigFromCAWithSignerOptions(t *testing.T) {
+	tlsConfig := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa, goproxy.WithSignerOptions(goproxy.SignerOptions{
+		KeyAlgorithm: goproxy.KeyAlgorithmECDSAP256,
+		Validity:     90 * 24 * time.Hour,
+		OCSPServer:   []string{"http://ocsp.example.com"},
+	}))
+	config, err := tlsConfig("example.com:443", &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, x509.ECDSA, leaf.PublicKeyAlgorithm)
+	assert.Equal(t, x509.SHA256WithRSA, leaf.SignatureAlgorithm)
+	assert.WithinDuration(t, time.Now().Add(90*24*time.Hour), leaf.NotAfter, time.Minute)
+	assert.Equal(t, []string{"http://ocsp.example.com"}, leaf.OCSPServer)
+	assert.Equal(t, []string{"example.com"}, leaf.DNSNames)
+}
+
 func TestHttpsMitmURLRewrite(t *testing.T) {
 	scheme := "https"
 
@@ -1460,6 +1617,61 @@ func TestMITMResponseHTTP2ProtoVersion(t *testing.T) {
 		"MITM'd client should receive HTTP/1.x response, got %s", resp.Proto)
 }
 
+func TestMitmNoContentResponse(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = io.WriteString(w, "next")
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	conn, err := (&net.Dialer{}).DialContext(context.Background(), "tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	connectReq, _ := http.NewRequestWithContext(context.Background(), http.MethodConnect, backend.URL, nil)
+	require.NoError(t, connectReq.Write(conn))
+	connectResp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, connectResp.StatusCode)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, tlsConn.HandshakeContext(context.Background()))
+	tlsBr := bufio.NewReader(tlsConn)
+
+	// The raw head of the 204 response has no Transfer-Encoding
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL+"/empty", nil)
+	require.NoError(t, req.Write(tlsConn))
+	var head strings.Builder
+	for {
+		line, err := tlsBr.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	assert.True(t, strings.HasPrefix(head.String(), "HTTP/1.1 204 No Content\r\n"), head.String())
+	assert.NotContains(t, strings.ToLower(head.String()), "transfer-encoding")
+
+	// No body follows it: the next response is read right after its head
+	req, _ = http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL+"/next", nil)
+	require.NoError(t, req.Write(tlsConn))
+	resp, err := http.ReadResponse(tlsBr, req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "next", string(body))
+}
+
 // TestTrailersForwarded verifies that response trailers (e.g. gRPC's
 // grpc-status, grpc-message) emitted by the upstream server are forwarded
 // through the proxy to the client.
@@ -1534,3 +1746,88 @@ func TestNoTrailersUnchanged(t *testing.T) {
 	require.Equal(t, "ok", strings.TrimSpace(string(body)))
 	require.Empty(t, resp.Trailer)
 }
+
+func TestResponseBodyReadErrorAbortsResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Large enough for the headers to reach the client before the failure
+		_, _ = io.WriteString(w, strings.Repeat("partial", 10000))
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Body = io.NopCloser(io.MultiReader(resp.Body, iotest.ErrReader(errors.New("upstream failure"))))
+		return resp
+	})
+	client, proxySrv := oneShotProxy(proxy)
+	defer proxySrv.Close()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, upstream.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	require.Error(t, err, "the client must notice the truncated body")
+}
+
+func TestTruncatedUpstreamBodyAbortsResponse(t *testing.T) {
+	// The upstream servers close their connection in the middle of the body
+	testCases := map[string]string{
+		"content length": "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial",
+		"chunked":        "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\npartial\r\n",
+	}
+	for name, raw := range testCases {
+		t.Run(name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				_, _ = io.WriteString(conn, raw)
+				_ = conn.Close()
+			}))
+			defer upstream.Close()
+
+			client, proxySrv := oneShotProxy(goproxy.NewProxyHttpServer())
+			defer proxySrv.Close()
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, upstream.URL, nil)
+			require.NoError(t, err)
+			// Depending on whether the headers were flushed, either the
+			// response or its body fail
+			resp, err := client.Do(req)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+			}
+			require.Error(t, err, "the client must notice the truncated body")
+		})
+	}
+}
+
+func TestMitmConnectReq(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	// Like authentication handlers, remove the credentials of the CONNECT
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Req.Header.Del("Proxy-Authorization")
+		return goproxy.MitmConnect, host
+	})
+	connectAuth := make(chan string, 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.ConnectReq == nil {
+			connectAuth <- "not MITM'd"
+		} else {
+			connectAuth <- ctx.ConnectReq.Header.Get("Proxy-Authorization")
+		}
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	proxyURL.User = url.UserPassword("user", "pass")
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")), <-connectAuth)
+}
@@ -0,0 +1,154 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how the proxy retries a request when the round trip
+// to the destination server fails with a transient error or status code.
+// It applies to plain HTTP requests as well as to requests read from a MITM'd
+// connection. Set ProxyHttpServer.Retry to enable it.
+//
+// By default only requests using an idempotent method (GET, HEAD, OPTIONS,
+// TRACE, PUT, DELETE) are retried. A request with a body is retried only when
+// its body is replayable, that is when req.GetBody is set, which a ReqHandler
+// can do after buffering the body. Requests using other methods, like POST,
+// are only retried when Retryable allows them, since the destination server
+// may have acted on them before failing.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of round trips made for a request,
+	// including the first one. Values lower than 2 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles after every
+	// following attempt, up to MaxBackoff. Defaults to 100ms.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between two attempts. Defaults to 2s.
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is
+	// randomized, so that clients failing together don't retry together.
+	Jitter float64
+	// RetryStatus lists the response status codes that are retried,
+	// for example http.StatusBadGateway or http.StatusServiceUnavailable.
+	RetryStatus []int
+	// RetryError reports whether a round trip error should be retried.
+	// Defaults to IsTransientError.
+	RetryError func(err error) bool
+	// Retryable reports whether a request may be sent more than once.
+	// It replaces the default idempotency and body replayability check.
+	Retryable func(req *http.Request) bool
+}
+
+// IsTransientError reports whether err is a network error that is likely
+// to go away when the request is retried, such as a refused or reset
+// connection, a timeout or a connection closed before the response was read.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryable(req *http.Request) bool {
+	if p.Retryable != nil {
+		return p.Retryable(req)
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+	return isIdempotent(req.Method) && (!hasBody || req.GetBody != nil)
+}
+
+func (p *RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		if p.RetryError != nil {
+			return p.RetryError(err)
+		}
+		return IsTransientError(err)
+	}
+	return resp != nil && slices.Contains(p.RetryStatus, resp.StatusCode)
+}
+
+// delay returns the time to wait after the given (1-based) failed attempt.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	backoff, maxBackoff := p.Backoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 2 * time.Second
+	}
+	d := backoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxBackoff)
+	if jitter := min(max(p.Jitter, 0), 1); jitter > 0 {
+		spread := time.Duration(float64(d) * jitter)
+		d = d - spread + rand.N(spread+1)
+	}
+	return d
+}
+
+// roundTrip sends req through ctx.RoundTrip, retrying it according to
+// proxy.Retry. The number of attempts made is recorded in ctx.Attempts.
+func (proxy *ProxyHttpServer) roundTrip(ctx *ProxyCtx, req *http.Request) (*http.Response, error) {
+	ctx.Attempts = 1
+	req.Body = throttleBody(req.Context(), req.Body, ctx.UpstreamThrottle)
+	policy := proxy.Retry
+	if policy == nil || policy.MaxAttempts < 2 || !policy.retryable(req) {
+		return ctx.RoundTrip(req)
+	}
+	for {
+		resp, err := ctx.RoundTrip(req)
+		if ctx.Attempts >= policy.MaxAttempts || !policy.shouldRetry(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			ctx.Logf("Attempt %d of %v %v returned %v, retrying", ctx.Attempts, req.Method, req.URL, resp.Status)
+			_, _ = io.CopyN(io.Discard, resp.Body, _errorRespMaxLength)
+			_ = resp.Body.Close()
+		} else {
+			ctx.Logf("Attempt %d of %v %v failed, retrying: %v", ctx.Attempts, req.Method, req.URL, err)
+		}
+
+		timer := time.NewTimer(policy.delay(ctx.Attempts))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = throttleBody(req.Context(), body, ctx.UpstreamThrottle)
+		}
+		ctx.Attempts++
+	}
+}
@@ -0,0 +1,155 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replayableBody buffers the body of req so that it can be retried.
+func replayableBody(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return req, nil
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return req, nil
+}
+
+// flakyHandler fails the first failures requests, either by resetting
+// the connection or by answering with a 503, then answers "ok".
+type flakyHandler struct {
+	failures int32
+	reset    bool
+	calls    atomic.Int32
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.calls.Add(1) <= h.failures {
+		if h.reset {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = io.WriteString(w, "ok")
+}
+
+func TestRetryPolicy(t *testing.T) {
+	testCases := []struct {
+		name       string
+		method     string
+		body       string
+		replayable bool
+		handler    *flakyHandler
+		status     int
+		attempts   int32
+	}{
+		{"status retried", http.MethodGet, "", false, &flakyHandler{failures: 2}, http.StatusOK, 3},
+		{"reset retried", http.MethodGet, "", false, &flakyHandler{failures: 1, reset: true}, http.StatusOK, 2},
+		{"attempts exhausted", http.MethodGet, "", false, &flakyHandler{failures: 5}, http.StatusServiceUnavailable, 3},
+		{"put not retried", http.MethodPut, "data", false, &flakyHandler{failures: 1}, http.StatusServiceUnavailable, 1},
+		{"replayable put retried", http.MethodPut, "data", true, &flakyHandler{failures: 1}, http.StatusOK, 2},
+		{"post not retried", http.MethodPost, "data", false, &flakyHandler{failures: 1}, http.StatusServiceUnavailable, 1},
+		{"replayable post not retried", http.MethodPost, "data", true, &flakyHandler{failures: 1}, http.StatusServiceUnavailable, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			background := httptest.NewServer(tc.handler)
+			defer background.Close()
+
+			proxy := goproxy.NewProxyHttpServer()
+			// Avoid the transport silently retrying on its own
+			proxy.Tr.DisableKeepAlives = true
+			proxy.Retry = &goproxy.RetryPolicy{
+				MaxAttempts: 3,
+				Backoff:     time.Millisecond,
+				Jitter:      0.5,
+				RetryStatus: []int{http.StatusServiceUnavailable},
+			}
+			if tc.replayable {
+				proxy.OnRequest().DoFunc(replayableBody)
+			}
+			var attempts atomic.Int32
+			proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+				attempts.Store(int32(ctx.Attempts))
+				return resp
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			req, err := http.NewRequestWithContext(context.Background(), tc.method, background.URL, strings.NewReader(tc.body))
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tc.status, resp.StatusCode)
+			assert.Equal(t, tc.attempts, tc.handler.calls.Load())
+			assert.Equal(t, tc.attempts, attempts.Load())
+		})
+	}
+}
+
+func TestRetryPolicyMitm(t *testing.T) {
+	handler := &flakyHandler{failures: 2}
+	background := httptest.NewTLSServer(handler)
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.Tr.DisableKeepAlives = true
+	proxy.Retry = &goproxy.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		RetryStatus: []int{http.StatusServiceUnavailable},
+	}
+	var attempts atomic.Int32
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		attempts.Store(int32(ctx.Attempts))
+		return resp
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "ok", string(getOrFail(t, background.URL, client)))
+	assert.Equal(t, int32(3), handler.calls.Load())
+	assert.Equal(t, int32(3), attempts.Load())
+
+	// Retrying a POST request needs Retryable
+	handler.calls.Store(0)
+	handler.failures = 1
+	resp, err := client.Post(background.URL, "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	handler.calls.Store(0)
+	proxy.OnRequest().DoFunc(replayableBody)
+	proxy.Retry.Retryable = func(req *http.Request) bool {
+		return req.GetBody != nil
+	}
+	resp, err = client.Post(background.URL, "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), handler.calls.Load())
+}
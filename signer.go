@@ -0,0 +1,89 @@
+package goproxy
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"github.com/elazarl/goproxy/internal/signer"
+)
+
+// KeyAlgorithm is the algorithm of the keys of the certificates generated for
+// MITM'd hosts.
+type KeyAlgorithm int
+
+const (
+	// KeyAlgorithmCA generates keys of the algorithm of the CA key, RSA keys
+	// being 2048 bits long and ECDSA keys using P-256.
+	KeyAlgorithmCA KeyAlgorithm = iota
+	KeyAlgorithmRSA2048
+	KeyAlgorithmRSA3072
+	KeyAlgorithmRSA4096
+	KeyAlgorithmECDSAP256
+	KeyAlgorithmECDSAP384
+	KeyAlgorithmEd25519
+)
+
+// SignerOptions customizes the certificates generated for MITM'd hosts, see
+// WithSignerOptions. The zero value generates the default certificates.
+type SignerOptions struct {
+	// KeyAlgorithm of the certificates, independent of the one of the CA
+	KeyAlgorithm KeyAlgorithm
+	// Backdate is how long before their generation the certificates are valid,
+	// 30 days when zero, to tolerate the clock skew of the clients
+	Backdate time.Duration
+	// Validity is how long after their generation the certificates are valid,
+	// 365 days when zero
+	Validity time.Duration
+	// Subject of the certificates, whose CommonName is set to the hostname.
+	// The organization is "GoProxy untrusted MITM proxy Inc" when empty.
+	Subject pkix.Name
+	// KeyUsage of the certificates, digital signature and key encipherment
+	// when zero
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsage of the certificates, server authentication when nil
+	ExtKeyUsage []x509.ExtKeyUsage
+	// OCSPServer, IssuingCertificateURL and CRLDistributionPoints are the URLs
+	// clients check the revocation of the certificates at
+	OCSPServer            []string
+	IssuingCertificateURL []string
+	CRLDistributionPoints []string
+	// ExtraExtensions are added to the certificates, replacing the ones
+	// generated from the other fields with the same id
+	ExtraExtensions []pkix.Extension
+	// SerialNumber returns the serial number of the next certificate, a random
+	// positive 63 bits number when nil. It is called concurrently.
+	SerialNumber func() (*big.Int, error)
+	// KeyPool provides the keys of the certificates when it isn't exhausted,
+	// see NewKeyPool
+	KeyPool *KeyPool
+}
+
+// WithSignerOptions customizes the generated certificates with opts.
+// Certificates already in the CertStorage of the proxy are still served, so
+// a namespace should be set when changing the options of a persistent storage,
+// see WithCertStorageNamespace.
+func WithSignerOptions(opts SignerOptions) TLSConfigOption {
+	return func(o *tlsConfigOptions) {
+		var keySource func(algorithm signer.KeyAlgorithm) crypto.Signer
+		if opts.KeyPool != nil {
+			keySource = opts.KeyPool.key
+		}
+		o.signer = &signer.Options{
+			KeyAlgorithm:          signer.KeyAlgorithm(opts.KeyAlgorithm),
+			Backdate:              opts.Backdate,
+			Validity:              opts.Validity,
+			Subject:               opts.Subject,
+			KeyUsage:              opts.KeyUsage,
+			ExtKeyUsage:           opts.ExtKeyUsage,
+			OCSPServer:            opts.OCSPServer,
+			IssuingCertificateURL: opts.IssuingCertificateURL,
+			CRLDistributionPoints: opts.CRLDistributionPoints,
+			ExtraExtensions:       opts.ExtraExtensions,
+			SerialNumber:          opts.SerialNumber,
+			KeySource:             keySource,
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// Throttle limits the rate at which data is transferred through the proxy.
+type Throttle interface {
+	// WaitN blocks until n more bytes may be transferred, or ctx is done.
+	WaitN(ctx context.Context, n int) error
+}
+
+// _throttleChunkSize bounds the size of each throttled read, so that slow
+// rates still deliver data regularly instead of in large bursts.
+const _throttleChunkSize = 4 * 1024
+
+type throttledReader struct {
+	r io.Reader
+	// wait blocks until n more bytes may be read, the context of the
+	// transfer being bound to it rather than stored
+	wait func(n int) error
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > _throttleChunkSize {
+		p = p[:_throttleChunkSize]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type throttledReadCloser struct {
+	throttledReader
+	io.Closer
+}
+
+// throttleReader returns r limited by throttle, or r itself if there is no throttle.
+func throttleReader(ctx context.Context, r io.Reader, throttle Throttle) io.Reader {
+	if throttle == nil {
+		return r
+	}
+	return &throttledReader{r: r, wait: waitFunc(ctx, throttle)}
+}
+
+// throttleBody returns body limited by throttle, or body itself if there is
+// no throttle or no body.
+func throttleBody(ctx context.Context, body io.ReadCloser, throttle Throttle) io.ReadCloser {
+	if throttle == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	return &throttledReadCloser{
+		throttledReader: throttledReader{r: body, wait: waitFunc(ctx, throttle)},
+		Closer:          body,
+	}
+}
+
+func waitFunc(ctx context.Context, throttle Throttle) func(n int) error {
+	return func(n int) error {
+		return throttle.WaitN(ctx, n)
+	}
+}
@@ -0,0 +1,90 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingThrottle never blocks, it only counts the bytes it lets through.
+type countingThrottle struct {
+	n atomic.Int64
+}
+
+func (c *countingThrottle) WaitN(ctx context.Context, n int) error {
+	c.n.Add(int64(n))
+	return nil
+}
+
+func TestThrottles(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, strings.Repeat("d", 2000))
+	}))
+	defer background.Close()
+
+	var upstream, downstream countingThrottle
+	proxy := goproxy.NewProxyHttpServer()
+	setThrottles := func(ctx *goproxy.ProxyCtx) {
+		ctx.UpstreamThrottle = &upstream
+		ctx.DownstreamThrottle = &downstream
+	}
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		setThrottles(ctx)
+		return req, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		setThrottles(ctx)
+		return goproxy.OkConnect, host
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	t.Run("http", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, background.URL, strings.NewReader(strings.Repeat("u", 1000)))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, int64(1000), upstream.n.Load())
+		assert.Equal(t, int64(2000), downstream.n.Load())
+	})
+
+	t.Run("tunnel", func(t *testing.T) {
+		upstream.n.Store(0)
+		downstream.n.Store(0)
+		proxyURL, _ := url.Parse(s.URL)
+		backgroundURL, _ := url.Parse(background.URL)
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "CONNECT "+backgroundURL.Host+" HTTP/1.1\r\n\r\n")
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		req := "GET / HTTP/1.1\r\nHost: " + backgroundURL.Host + "\r\n\r\n"
+		_, err = io.WriteString(conn, req)
+		require.NoError(t, err)
+		resp, err = http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, int64(len(req)), upstream.n.Load())
+		assert.Greater(t, downstream.n.Load(), int64(2000))
+	})
+}
@@ -42,12 +42,12 @@ func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, remoteConn io.ReadWr
 	// https://stackoverflow.com/questions/52031332/wait-for-one-goroutine-to-finish
 	waitChan := make(chan struct{}, 2)
 	go func() {
-		_ = copyOrWarn(ctx, remoteConn, proxyClient)
+		_, _ = copyOrWarn(ctx, remoteConn, proxyClient, ctx.UpstreamThrottle)
 		waitChan <- struct{}{}
 	}()
 
 	go func() {
-		_ = copyOrWarn(ctx, proxyClient, remoteConn)
+		_, _ = copyOrWarn(ctx, proxyClient, remoteConn, ctx.DownstreamThrottle)
 		waitChan <- struct{}{}
 	}()
 